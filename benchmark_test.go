@@ -0,0 +1,54 @@
+package lunar
+
+import (
+	"io"
+	"testing"
+)
+
+// benchmarkScript loads one of the benchmark scripts over and over, in a
+// new interpreter each time, since the functions it defines would be in
+// the way of defining them again.
+func benchmarkScript(b *testing.B, fn string) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		interp := NewInterpreter()
+		interp.Outs = io.Discard
+		b.StartTimer()
+		if _, err := Load(fn, interp.Toplevel); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkScript(b, "benchmarks/benchmark1.lulz")
+}
+
+// Conditions for while and ifelse are parsed once, then kept with the
+// list; uncached is what it would cost to parse them each time.
+func BenchmarkConditions(b *testing.B) {
+	interp := NewInterpreter()
+	code, err := interp.ParseTokens(
+		Tokenize(`[and gt :n 0 lt mod :n 7 add :n 1]`, Pos{}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cond := code[0].(List)
+	b.Run("cached", func (b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := interp.parsed(cond); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("uncached", func (b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := interp.parseWords(cond); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("script", func (b *testing.B) {
+		benchmarkScript(b, "benchmarks/benchmark2.lulz")
+	})
+}
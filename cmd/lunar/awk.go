@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/felixp7/lunar-logo"
+)
+
+// script is code given with -e, split into the parts that run before
+// any input, once per line, and after all input, respectively.
+type script struct {
+	begin lunar.List
+	body lunar.List
+	end lunar.List
+}
+
+// skip returns the index of the token after the item starting at cursor,
+// taking whole literal lists, blocks and comments as one item.
+func skip(tokens []lunar.Token, cursor int) int {
+	t := tokens[cursor]
+	word := strings.ToLower(t.Word)
+	cursor++
+	if t.Quoted {
+		return cursor
+	} else if word == "[" {
+		depth := 1
+		for cursor < len(tokens) && depth > 0 {
+			if tokens[cursor].Quoted {
+				// Brackets in strings don't count.
+			} else if tokens[cursor].Word == "[" {
+				depth++
+			} else if tokens[cursor].Word == "]" {
+				depth--
+			}
+			cursor++
+		}
+	} else if strings.HasPrefix(word, "--") {
+		for cursor < len(tokens) && tokens[cursor].Line == t.Line {
+			cursor++
+		}
+	} else if word == "do" {
+		for cursor < len(tokens) && !isWord(tokens[cursor], "end") {
+			cursor = skip(tokens, cursor)
+		}
+		cursor++
+	}
+	return cursor
+}
+
+// isWord tells if a token is the given keyword.
+func isWord(t lunar.Token, word string) bool {
+	return !t.Quoted && strings.EqualFold(t.Word, word)
+}
+
+// compile sorts code into BEGIN and END blocks, and everything else.
+func compile(interp *lunar.Interpreter, code string) (*script, error) {
+	pos := lunar.Pos{File: "-e", Line: 1, Column: 1}
+	tokens := lunar.Tokenize(code, pos)
+	var begin, body, end []lunar.Token
+	cursor := 0
+	for cursor < len(tokens) {
+		t := tokens[cursor]
+		if (isWord(t, "begin") || isWord(t, "end")) &&
+			cursor + 1 < len(tokens) &&
+			isWord(tokens[cursor + 1], "do") {
+			csr := skip(tokens, cursor + 1)
+			if csr > len(tokens) {
+				return nil, lunar.Error{
+					Data: "Unexpected end of input in block.",
+					Pos: t.Pos}
+			} else if isWord(t, "begin") {
+				begin = append(begin, tokens[cursor + 2:csr - 1]...)
+			} else {
+				end = append(end, tokens[cursor + 2:csr - 1]...)
+			}
+			cursor = csr
+		} else {
+			csr := skip(tokens, cursor)
+			if csr > len(tokens) {
+				// Leave it to the parser to complain.
+				csr = len(tokens)
+			}
+			body = append(body, tokens[cursor:csr]...)
+			cursor = csr
+		}
+	}
+	var err error
+	prog := &script{}
+	if prog.begin, err = interp.ParseTokens(begin); err != nil {
+		return nil, err
+	} else if prog.body, err = interp.ParseTokens(body); err != nil {
+		return nil, err
+	} else if prog.end, err = interp.ParseTokens(end); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// results runs code at top level, printing any results like run does.
+func results(interp *lunar.Interpreter, code lunar.List) (err error) {
+	defer interp.Toplevel.Reset()
+	defer func () {
+		// ToString panics on values it can't print.
+		if e := recover(); e != nil {
+			err = e.(lunar.Error)
+		}
+	}()
+	values, err := lunar.Results(code, interp.Toplevel)
+	if err != nil {
+		return err
+	}
+	for _, i := range(values) {
+		if i != nil {
+			fmt.Fprintln(interp.Outs, lunar.ToString(i))
+		}
+	}
+	return nil
+}
+
+// awk runs code for each line in the given files, or standard input,
+// with the line in :line, split into :fields, and counted by :nr and :nf.
+func awk(interp *lunar.Interpreter, code, sep string, files []string) error {
+	prog, err := compile(interp, code)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(sep, `\`) {
+		// Allow escapes like -F '\t', as Awk does.
+		if tmp, err := strconv.Unquote(`"` + sep + `"`); err == nil {
+			sep = tmp
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	if err := results(interp, prog.begin); err != nil {
+		return err
+	}
+	names := interp.Toplevel.Names
+	split := interp.Procedures["split-by"]
+	nr := 0
+	for _, fn := range(files) {
+		err := eachLine(interp, fn, func (line string) error {
+			var fields interface{}
+			var err error
+			if sep == "" {
+				fields = lunar.Split(line)
+			} else if fields, err = split.Call(
+				interp.Toplevel, sep, line); err != nil {
+				return err
+			}
+			nr++
+			names["line"] = line
+			names["fields"] = fields
+			names["nr"] = nr
+			names["nf"] = len(fields.(lunar.List))
+			return results(interp, prog.body)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return results(interp, prog.end)
+}
+
+// eachLine calls do for each line in a file, or standard input for "-",
+// closing the file once done.
+func eachLine(
+	interp *lunar.Interpreter, fn string, do func (string) error) error {
+	in := interp.Input()
+	if fn != "-" {
+		var err error
+		if in, err = lunar.Open(fn, "r"); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	for {
+		line, err := in.ReadLine()
+		if err == bufio.ErrFinalToken {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := do(line); err != nil {
+			return err
+		}
+	}
+}
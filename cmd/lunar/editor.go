@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupt means the user pressed Ctrl-C to abandon a line.
+var errInterrupt = errors.New("interrupted")
+
+// editor reads lines of input, with editing and history on a terminal.
+type editor struct {
+	in *os.File
+	out io.Writer
+	terminal bool
+	
+	history []string
+	file *os.File
+	
+	// Complete, if set, gets the text before the cursor and returns the
+	// word being typed along with all its possible completions.
+	Complete func (head string) (string, []string)
+}
+
+func newEditor(in *os.File, out io.Writer) *editor {
+	return &editor{in: in, out: out, terminal: isTerminal(int(in.Fd()))}
+}
+
+// LoadHistory reads previous input from a file and appends new input to it,
+// keeping only the most recent lines.
+func (self *editor) LoadHistory(fn string, size int) error {
+	if data, err := os.ReadFile(fn); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			self.history = append(self.history, scanner.Text())
+		}
+		if len(self.history) > size {
+			self.history = self.history[len(self.history) - size:]
+			text := strings.Join(self.history, "\n") + "\n"
+			os.WriteFile(fn, []byte(text), 0600)
+		}
+	}
+	file, err := os.OpenFile(
+		fn, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+	if err != nil { return err }
+	self.file = file
+	return nil
+}
+
+// Remember adds a line to the history, unless it's empty or a repeat.
+func (self *editor) Remember(line string) {
+	if strings.TrimSpace(line) == "" { return }
+	last := len(self.history) - 1
+	if last >= 0 && self.history[last] == line { return }
+	self.history = append(self.history, line)
+	if self.file != nil {
+		fmt.Fprintln(self.file, line)
+	}
+}
+
+func (self *editor) Close() {
+	if self.file != nil {
+		self.file.Close()
+	}
+}
+
+// Readline shows a prompt and returns the line entered, sans newline.
+func (self *editor) Readline(prompt string) (string, error) {
+	if !self.terminal {
+		return self.readPlain()
+	}
+	restore, err := makeRaw(int(self.in.Fd()))
+	if err != nil {
+		fmt.Fprint(self.out, prompt)
+		return self.readPlain()
+	}
+	defer restore()
+	
+	line := make([]rune, 0)
+	pos := 0
+	index := len(self.history)
+	saved := ""
+	browse := func (i int) {
+		if index == len(self.history) {
+			saved = string(line)
+		}
+		index = i
+		if index == len(self.history) {
+			line = []rune(saved)
+		} else {
+			line = []rune(self.history[index])
+		}
+		pos = len(line)
+	}
+	for {
+		self.refresh(prompt, line, pos)
+		r, err := self.readRune()
+		if err != nil { return "", err }
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(self.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(self.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(self.out, "\r\n")
+				return "", io.EOF
+			} else if pos < len(line) {
+				line = append(line[:pos], line[pos + 1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 2: // Ctrl-B
+			if pos > 0 { pos-- }
+		case 6: // Ctrl-F
+			if pos < len(line) { pos++ }
+		case 8, 127: // Backspace
+			if pos > 0 {
+				line = append(line[:pos - 1], line[pos:]...)
+				pos--
+			}
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = append(line[:0], line[pos:]...)
+			pos = 0
+		case 9: // Tab
+			line, pos = self.complete(prompt, line, pos)
+		case 16: // Ctrl-P
+			if index > 0 { browse(index - 1) }
+		case 14: // Ctrl-N
+			if index < len(self.history) { browse(index + 1) }
+		case 27: // Escape sequence
+			switch self.readEscape() {
+			case 'A':
+				if index > 0 { browse(index - 1) }
+			case 'B':
+				if index < len(self.history) {
+					browse(index + 1)
+				}
+			case 'C':
+				if pos < len(line) { pos++ }
+			case 'D':
+				if pos > 0 { pos-- }
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '~':
+				if pos < len(line) {
+					line = append(
+						line[:pos], line[pos + 1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				line = append(line, 0)
+				copy(line[pos + 1:], line[pos:])
+				line[pos] = r
+				pos++
+			}
+		}
+	}
+}
+
+// complete expands the word before the cursor as far as it's unambiguous,
+// or lists the options if it can't go any further.
+func (self *editor) complete(
+	prompt string, line []rune, pos int) ([]rune, int) {
+	if self.Complete == nil { return line, pos }
+	word, options := self.Complete(string(line[:pos]))
+	if len(options) == 0 { return line, pos }
+	prefix := options[0]
+	for _, i := range(options[1:]) {
+		for !strings.HasPrefix(i, prefix) {
+			prefix = prefix[:len(prefix) - 1]
+		}
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix) - 1]
+	}
+	if len(options) == 1 && !strings.HasSuffix(prefix, "/") {
+		prefix += " "
+	}
+	if len(prefix) > len(word) {
+		tail := []rune(prefix[len(word):])
+		ext := make([]rune, 0, len(line) + len(tail))
+		ext = append(ext, line[:pos]...)
+		ext = append(ext, tail...)
+		ext = append(ext, line[pos:]...)
+		return ext, pos + len(tail)
+	}
+	sort.Strings(options)
+	fmt.Fprintf(self.out, "\r\n%s\r\n", strings.Join(options, "  "))
+	return line, pos
+}
+
+// refresh redraws the line being edited and puts the cursor in place.
+func (self *editor) refresh(prompt string, line []rune, pos int) {
+	fmt.Fprintf(self.out, "\r%s%s\x1b[K", prompt, string(line))
+	if back := len(line) - pos; back > 0 {
+		fmt.Fprintf(self.out, "\x1b[%dD", back)
+	}
+}
+
+// readEscape reads the rest of an escape sequence, returning its final
+// character; the keys for home, end and delete come out as H, F and ~.
+func (self *editor) readEscape() rune {
+	r, err := self.readRune()
+	if err != nil || (r != '[' && r != 'O') { return 0 }
+	r, err = self.readRune()
+	if err != nil { return 0 }
+	num := r
+	for (r >= '0' && r <= '9') || r == ';' {
+		r, err = self.readRune()
+		if err != nil { return 0 }
+	}
+	if r != '~' { return r }
+	switch num {
+		case '1', '7': return 'H'
+		case '4', '8': return 'F'
+		case '3': return '~'
+		default: return 0
+	}
+}
+
+func (self *editor) readRune() (rune, error) {
+	buf := make([]byte, 0, utf8.UTFMax)
+	b := make([]byte, 1)
+	for !utf8.FullRune(buf) {
+		if _, err := self.in.Read(b); err != nil {
+			return 0, err
+		}
+		buf = append(buf, b[0])
+	}
+	r, _ := utf8.DecodeRune(buf)
+	return r, nil
+}
+
+// readPlain reads a line one byte at a time, so as not to take away
+// input meant for the program being run.
+func (self *editor) readPlain() (string, error) {
+	line := make([]byte, 0)
+	b := make([]byte, 1)
+	for {
+		n, err := self.in.Read(b)
+		if n > 0 && b[0] == '\n' {
+			break
+		} else if n > 0 {
+			line = append(line, b[0])
+		} else if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
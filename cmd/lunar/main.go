@@ -0,0 +1,100 @@
+// Command lunar runs Lunar Logo code given on the command line, or starts
+// an interactive session.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/felixp7/lunar-logo"
+)
+
+const banner = "Lunar Logo beta, 2017-02-09"
+
+var interactive = flag.Bool(
+	"i", false, "start an interactive session after running any code")
+var perLine = flag.String(
+	"e", "", "run code for each line of the given files or standard input")
+var fieldSep = flag.String(
+	"F", "", "split lines for -e by this separator instead of whitespace")
+
+// traceLimit is how many frames report shows at either end of a long stack.
+const traceLimit = 10
+
+// report prints an error, preceded by a traceback if there is one.
+func report(out io.Writer, err error) {
+	if e, ok := err.(lunar.Error); ok && len(e.Stack) > 0 {
+		fmt.Fprintln(out, "Traceback (most recent call last):")
+		for i, frame := range(e.Stack) {
+			if len(e.Stack) <= 2 * traceLimit + 1 {
+				// Show everything.
+			} else if i == traceLimit {
+				fmt.Fprintf(out, "\t... %d more frames ...\n",
+					len(e.Stack) - 2 * traceLimit)
+				continue
+			} else if i > traceLimit && i < len(e.Stack) - traceLimit {
+				continue
+			}
+			fmt.Fprintf(out, "\t%v\n", frame)
+		}
+	}
+	fmt.Fprintln(out, err)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, banner)
+	fmt.Fprintln(out, "Usage:\n\tlunar [-i] [logo code...]")
+	fmt.Fprintln(out, "\tlunar load <filename>")
+	fmt.Fprintln(out, "\tlunar [-F <separator>] -e <code> [files...]")
+	fmt.Fprintln(out, "With no code, starts an interactive session.")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	interp := lunar.NewInterpreter()
+	// Whoever runs a script from here trusts it with their files.
+	interp.Allow("filesystem", "load")
+	if *perLine != "" {
+		err := awk(interp, *perLine, *fieldSep, flag.Args())
+		if err != nil {
+			report(interp.Errs, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		run(interp, flag.Args())
+	}
+	if flag.NArg() == 0 || *interactive {
+		repl(interp)
+	}
+}
+
+// run parses and runs code from the command line, printing any results.
+func run(interp *lunar.Interpreter, args []string) {
+	defer func () {
+		if err := recover(); err != nil {
+			fmt.Fprintln(interp.Outs, err)
+		}
+	}()
+	code, err := lunar.Parse(args, interp.Procedures)
+	if err == nil {
+		results, err2 := lunar.Results(code, interp.Toplevel)
+		if err2 == nil {
+			for _, i := range(results) {
+				if i != nil {
+					fmt.Fprintln(interp.Outs, lunar.ToString(i))
+				}
+			}
+		} else {
+			report(interp.Errs, err2)
+		}
+	} else {
+		fmt.Fprintln(interp.Errs, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/felixp7/lunar-logo"
+)
+
+// historySize is how many lines of input the REPL keeps across sessions.
+const historySize = 1000
+
+// historyFile returns where to keep input history, or an empty string.
+func historyFile() string {
+	if fn := os.Getenv("LUNAR_HISTORY"); fn != "" {
+		return fn
+	} else if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".lunar_history")
+	} else {
+		return ""
+	}
+}
+
+// command gathers lines of input until blocks and lists are balanced.
+type command struct {
+	tokens []lunar.Token
+	blocks int
+	lists int
+}
+
+// Add tokenizes another line, dropping comments, and tells if the command
+// is complete.
+func (self *command) Add(line string, pos lunar.Pos) bool {
+	for _, t := range(lunar.Tokenize(line, pos)) {
+		word := strings.ToLower(t.Word)
+		if word == "[" {
+			self.lists++
+		} else if word == "]" {
+			self.lists--
+		} else if self.lists > 0 {
+			// Words in literal lists don't count.
+		} else if strings.HasPrefix(word, "--") {
+			break
+		} else if word == "do" {
+			self.blocks++
+		} else if word == "end" {
+			self.blocks--
+		}
+		self.tokens = append(self.tokens, t)
+	}
+	return self.lists <= 0 && self.blocks <= 0
+}
+
+// completer offers names of procedures and functions, variables after a
+// colon, and file names after LOAD.
+func completer(interp *lunar.Interpreter) func (string) (string, []string) {
+	return func (head string) (string, []string) {
+		start := strings.LastIndexAny(head, " \t[") + 1
+		word := head[start:]
+		before := strings.Fields(head[:start])
+		if n := len(before); n > 0 && strings.EqualFold(before[n - 1], "load") {
+			return word, completeFile(word)
+		}
+		lower := strings.ToLower(word)
+		options := make([]string, 0)
+		names := make(map[string]interface{})
+		for s := interp.Toplevel; s != nil; s = s.Parent {
+			for name, value := range(s.Names) {
+				if _, ok := names[name]; !ok {
+					names[name] = value
+				}
+			}
+		}
+		if strings.HasPrefix(word, ":") {
+			for name := range(names) {
+				if strings.HasPrefix(":" + name, lower) {
+					options = append(options, ":" + name)
+				}
+			}
+			return word, options
+		}
+		for _, name := range(keywords) {
+			if strings.HasPrefix(name, lower) {
+				options = append(options, name)
+			}
+		}
+		for name := range(interp.Procedures) {
+			if strings.HasPrefix(name, lower) {
+				options = append(options, name)
+			}
+		}
+		for name, value := range(names) {
+			_, ok := value.(lunar.Closure)
+			if ok && strings.HasPrefix(name, lower) {
+				options = append(options, name)
+			}
+		}
+		return word, options
+	}
+}
+
+// keywords are words the parser treats specially, besides procedures.
+var keywords = []string{"do", "end", "true", "false", "nil"}
+
+// completeFile lists the files and directories whose path starts with word.
+func completeFile(word string) []string {
+	dir, base := filepath.Split(word)
+	list := dir
+	if list == "" {
+		list = "."
+	}
+	entries, err := os.ReadDir(list)
+	if err != nil { return nil }
+	options := make([]string, 0)
+	for _, i := range(entries) {
+		name := i.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		} else if strings.HasPrefix(name, ".") &&
+			!strings.HasPrefix(base, ".") {
+			continue
+		} else if i.IsDir() {
+			options = append(options, dir + name + "/")
+		} else {
+			options = append(options, dir + name)
+		}
+	}
+	return options
+}
+
+// eval runs a command at top level, printing any results like main does.
+func eval(interp *lunar.Interpreter, tokens []lunar.Token) {
+	defer interp.Toplevel.Reset()
+	defer func () {
+		if err := recover(); err != nil {
+			fmt.Fprintln(interp.Errs, err)
+		}
+	}()
+	code, err := interp.ParseTokens(tokens)
+	if err != nil {
+		report(interp.Errs, err)
+		return
+	}
+	results, err := lunar.Results(code, interp.Toplevel)
+	if err != nil {
+		report(interp.Errs, err)
+		return
+	}
+	for _, i := range(results) {
+		if i != nil {
+			fmt.Fprintln(interp.Outs, lunar.ToString(i))
+		}
+	}
+}
+
+// repl reads commands and runs them until end of input or BYE.
+func repl(interp *lunar.Interpreter) {
+	ed := newEditor(os.Stdin, os.Stdout)
+	ed.Complete = completer(interp)
+	defer ed.Close()
+	if ed.terminal {
+		fmt.Println(banner)
+		fmt.Println("Enter your commands, or BYE to quit.")
+		if fn := historyFile(); fn != "" {
+			if err := ed.LoadHistory(fn, historySize); err != nil {
+				fmt.Fprintln(interp.Errs, err)
+			}
+		}
+	}
+	var cmd command
+	lineno := 0
+	for {
+		prompt := "> "
+		if len(cmd.tokens) > 0 {
+			prompt = ">> "
+		}
+		var line string
+		var err error
+		if ed.terminal {
+			line, err = ed.Readline(prompt)
+		} else {
+			// Share the buffer with readword and friends, so
+			// neither takes away input meant for the other.
+			line, err = interp.Input().ReadLine()
+		}
+		if err == errInterrupt {
+			cmd = command{}
+			continue
+		} else if err != nil {
+			break
+		}
+		lineno++
+		ed.Remember(line)
+		if len(cmd.tokens) == 0 &&
+			strings.EqualFold(strings.TrimSpace(line), "bye") {
+			break
+		}
+		pos := lunar.Pos{File: "<stdin>", Line: lineno, Column: 1}
+		if cmd.Add(line, pos) && len(cmd.tokens) > 0 {
+			eval(interp, cmd.tokens)
+			cmd = command{}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+const ioctlGetTermios = syscall.TIOCGETA
+const ioctlSetTermios = syscall.TIOCSETA
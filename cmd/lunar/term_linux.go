@@ -0,0 +1,8 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+const ioctlGetTermios = syscall.TCGETS
+const ioctlSetTermios = syscall.TCSETS
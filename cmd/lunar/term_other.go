@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+func makeRaw(fd int) (func (), error) {
+	return nil, errors.New("raw mode not supported on this platform")
+}
+
+func isTerminal(fd int) bool {
+	return false
+}
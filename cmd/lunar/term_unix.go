@@ -0,0 +1,55 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(fd int) (*syscall.Termios, error) {
+	state := new(syscall.Termios)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		ioctlGetTermios, uintptr(unsafe.Pointer(state)))
+	if errno != 0 {
+		return nil, errno
+	} else {
+		return state, nil
+	}
+}
+
+func setTermios(fd int, state *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		ioctlSetTermios, uintptr(unsafe.Pointer(state)))
+	if errno != 0 {
+		return errno
+	} else {
+		return nil
+	}
+}
+
+// makeRaw puts a terminal in raw mode and returns a function to undo it.
+func makeRaw(fd int) (func (), error) {
+	old, err := getTermios(fd)
+	if err != nil { return nil, err }
+	raw := *old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+		syscall.ISTRIP | syscall.INLCR | syscall.IGNCR |
+		syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+		syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return func () { setTermios(fd, old) }, nil
+}
+
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
@@ -0,0 +1,235 @@
+package lunar
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dict is a dictionary that remembers the order keys were first added in,
+// so going through it always gives the same results. Like lists, it's
+// shared rather than copied when passed around.
+//
+// Keys are matched the same way eq compares them, so lists and other
+// dictionaries can be keys too, going by what they hold at the time; if
+// they change afterwards, the entry won't be found by them anymore.
+type Dict struct {
+	index map[interface{}]int
+	entries []entry
+	deleted int
+}
+
+type entry struct {
+	key interface{}
+	hash interface{}
+	value interface{}
+	deleted bool
+}
+
+// compound stands for a list or dictionary key, spelled out in full
+// by writeKey. It's a type of its own so it can't clash with strings.
+type compound string
+
+// hashKey returns what the index goes by for a key: most values are fine
+// as they are, but floats that are whole numbers count as integers, like
+// in eq, and lists and dictionaries can't be compared by Go at all.
+func hashKey(key interface{}) interface{} {
+	switch key := key.(type) {
+	case float64:
+		if key == math.Trunc(key) && math.Abs(key) < 1 << 62 {
+			return int(key)
+		}
+	case List, *Dict:
+		var out strings.Builder
+		writeKey(&out, key, 0)
+		return compound(out.String())
+	case Closure, Builtin:
+		panic(Error{Data: "Can't use a procedure as a dictionary key."})
+	}
+	return key
+}
+
+// writeKey spells out a key so that values eq says are equal come out
+// the same, and no others do.
+func writeKey(out *strings.Builder, key interface{}, depth int) {
+	if depth > maxNesting {
+		panic(Error{Data: "Data nested too deeply for a dictionary key."})
+	}
+	switch key := key.(type) {
+	case nil:
+		out.WriteString("n")
+	case bool:
+		out.WriteString("b" + strconv.FormatBool(key) + ";")
+	case int:
+		out.WriteString("i" + strconv.Itoa(key) + ";")
+	case float64:
+		if whole, ok := hashKey(key).(int); ok {
+			out.WriteString("i" + strconv.Itoa(whole) + ";")
+		} else {
+			out.WriteString(
+				"f" + strconv.FormatFloat(key, 'g', -1, 64) + ";")
+		}
+	case string:
+		out.WriteString("s" + strconv.Itoa(len(key)) + ":" + key)
+	case List:
+		out.WriteString("[")
+		for _, i := range(key) {
+			writeKey(out, i, depth + 1)
+		}
+		out.WriteString("]")
+	case *Dict:
+		// Order doesn't matter to eq, so sort the entries.
+		pairs := make([]string, 0, key.Len())
+		for _, i := range(key.entries) {
+			if !i.deleted {
+				var pair strings.Builder
+				writeKey(&pair, i.key, depth + 1)
+				writeKey(&pair, i.value, depth + 1)
+				pairs = append(pairs, pair.String())
+			}
+		}
+		sort.Strings(pairs)
+		out.WriteString("{" + strings.Join(pairs, "") + "}")
+	case *Stream:
+		fmt.Fprintf(out, "p%p;", key)
+	default:
+		panic(FmtError("Can't use as a dictionary key:", key))
+	}
+}
+
+// NewDict returns a new dictionary off a list of alternating keys and values.
+func NewDict(init List) *Dict {
+	dictionary := &Dict{}
+	i := 0
+	for i < len(init) {
+		key := init[i]
+		i++
+		if i < len(init) {
+			dictionary.Put(key, init[i])
+		} else {
+			dictionary.Put(key, nil)
+		}
+		i++
+	}
+	return dictionary
+}
+
+func (self *Dict) Len() int {
+	return len(self.entries) - self.deleted
+}
+
+// Get returns the value for key, and whether it's there at all.
+func (self *Dict) Get(key interface{}) (interface{}, bool) {
+	if i, ok := self.index[hashKey(key)]; ok {
+		return self.entries[i].value, true
+	} else {
+		return nil, false
+	}
+}
+
+// Put sets the value for key; new keys go last.
+func (self *Dict) Put(key, value interface{}) {
+	hash := hashKey(key)
+	if i, ok := self.index[hash]; ok {
+		self.entries[i].value = value
+		return
+	}
+	if self.index == nil {
+		self.index = make(map[interface{}]int)
+	}
+	self.index[hash] = len(self.entries)
+	self.entries = append(self.entries,
+		entry{key: key, hash: hash, value: value})
+}
+
+// Del removes key from the dictionary, if it's there.
+func (self *Dict) Del(key interface{}) {
+	hash := hashKey(key)
+	i, ok := self.index[hash]
+	if !ok {
+		return
+	}
+	delete(self.index, hash)
+	self.entries[i] = entry{deleted: true}
+	self.deleted++
+	if self.deleted > len(self.entries) / 2 {
+		self.compact()
+	}
+}
+
+// compact gets rid of deleted entries, once there are too many of them.
+func (self *Dict) compact() {
+	live := make([]entry, 0, self.Len())
+	for _, i := range(self.entries) {
+		if !i.deleted {
+			self.index[i.hash] = len(live)
+			live = append(live, i)
+		}
+	}
+	self.entries = live
+	self.deleted = 0
+}
+
+// Keys returns the keys in the order they were added.
+func (self *Dict) Keys() List {
+	keys := make(List, 0, self.Len())
+	for _, i := range(self.entries) {
+		if !i.deleted {
+			keys = append(keys, i.key)
+		}
+	}
+	return keys
+}
+
+// Values returns the values in the same order as Keys.
+func (self *Dict) Values() List {
+	values := make(List, 0, self.Len())
+	for _, i := range(self.entries) {
+		if !i.deleted {
+			values = append(values, i.value)
+		}
+	}
+	return values
+}
+
+// Items returns a list of key-value pairs, each a list of two items,
+// in the same order as Keys.
+func (self *Dict) Items() List {
+	items := make(List, 0, self.Len())
+	for _, i := range(self.entries) {
+		if !i.deleted {
+			items = append(items, List{i.key, i.value})
+		}
+	}
+	return items
+}
+
+// Copy returns a shallow copy of the dictionary, in the same order.
+func (self *Dict) Copy() *Dict {
+	cp := &Dict{}
+	for _, i := range(self.entries) {
+		if !i.deleted {
+			cp.Put(i.key, i.value)
+		}
+	}
+	return cp
+}
+
+func (self *Dict) String() string {
+	var out strings.Builder
+	out.WriteString("map[")
+	first := true
+	for _, i := range(self.entries) {
+		if i.deleted {
+			continue
+		} else if !first {
+			out.WriteByte(' ')
+		}
+		fmt.Fprintf(&out, "%v:%v", i.key, i.value)
+		first = false
+	}
+	out.WriteString("]")
+	return out.String()
+}
@@ -0,0 +1,102 @@
+package lunar
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Format fills in a template with the given arguments, printf-style.
+// Each %v, %d, %f or %s directive takes the next argument; they can have
+// flags (- to pad on the right, 0 to pad with zeros, + to always show a
+// sign), a width and a precision, as in %-8s or %06.2f, while %% stands
+// for itself. %v shows values the way show does, and %s the way print
+// does, with lists run together; %d and %f convert to numbers first.
+func Format(template string, args List) (string, error) {
+	return format(template, args, 0)
+}
+
+// format is Format, except it checks that the text stays within limit
+// bytes, if positive, before filling in each directive.
+func format(template string, args List, limit int) (string, error) {
+	var out strings.Builder
+	next := 0
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			out.WriteByte(template[i])
+			continue
+		}
+		start := i
+		i++
+		skip := func (chars string) {
+			for i < len(template) &&
+				strings.IndexByte(chars, template[i]) >= 0 {
+				i++
+			}
+		}
+		skip("-0+ ")
+		digits := i
+		skip("0123456789")
+		width := template[digits:i]
+		precision := ""
+		if i < len(template) && template[i] == '.' {
+			i++
+			digits = i
+			skip("0123456789")
+			precision = template[digits:i]
+		}
+		grow := fieldSize(width) + fieldSize(precision)
+		if err := fitString(out.Len() + grow, limit); err != nil {
+			return "", err
+		}
+		if i >= len(template) {
+			return "", Error{Data: "Unfinished directive in format."}
+		} else if template[i] == '%' && i == start + 1 {
+			out.WriteByte('%')
+			continue
+		} else if next >= len(args) {
+			return "", Error{Data: "Not enough arguments for format."}
+		}
+		spec := template[start:i]
+		arg := args[next]
+		next++
+		if limit > 0 {
+			size := out.Len() + grow + printedSize(arg, limit, 0)
+			if err := fitString(size, limit); err != nil {
+				return "", err
+			}
+		}
+		switch template[i] {
+		case 'v':
+			fmt.Fprintf(&out, spec + "v", arg)
+		case 's':
+			if list, ok := arg.(List); ok {
+				arg = strings.Join(StringSlice(list), " ")
+			}
+			fmt.Fprintf(&out, spec + "s", ToString(arg))
+		case 'd':
+			fmt.Fprintf(&out, spec + "d", ParseInt(arg))
+		case 'f':
+			fmt.Fprintf(&out, spec + "f", ParseFloat(arg))
+		default:
+			return "", FmtError(
+				"Unknown directive in format:", template[start:i + 1])
+		}
+	}
+	if next < len(args) {
+		return "", Error{Data: "Too many arguments for format."}
+	}
+	return out.String(), nil
+}
+
+// fieldSize reads the width or precision of a directive, if any.
+func fieldSize(digits string) int {
+	if digits == "" {
+		return 0
+	} else if n, err := strconv.Atoi(digits); err == nil {
+		return n
+	} else {
+		return math.MaxInt32
+	}
+}
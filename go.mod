@@ -0,0 +1,3 @@
+module github.com/felixp7/lunar-logo
+
+go 1.24
@@ -0,0 +1,188 @@
+package lunar
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxNesting keeps ToJSON, and comparisons, from going around in circles
+// forever, since lists and dictionaries can end up containing themselves.
+const maxNesting = 1000
+
+// ToJSON encodes a value as JSON. Dictionaries must have string keys,
+// which come out in the same order as they were added.
+func ToJSON(value interface{}) (string, error) {
+	// An interpreter of its own has no limits.
+	return (&Interpreter{}).toJSON(value)
+}
+
+// toJSON is ToJSON, except it gives up as soon as the text is too long
+// for the interpreter.
+func (self *Interpreter) toJSON(value interface{}) (string, error) {
+	var out strings.Builder
+	if err := self.writeJSON(&out, value, 0); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func (self *Interpreter) writeJSON(
+	out *strings.Builder, value interface{}, depth int) error {
+	if depth > maxNesting {
+		return Error{Data: "Data nested too deeply for JSON."}
+	}
+	switch value := value.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(value))
+	case int:
+		out.WriteString(strconv.Itoa(value))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return FmtError("Can't convert to JSON:", value)
+		}
+		out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	case string:
+		writeJSONString(out, value)
+	case List:
+		out.WriteByte('[')
+		for i, item := range(value) {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := self.writeJSON(out, item, depth + 1);
+				err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case *Dict:
+		out.WriteByte('{')
+		for i, item := range(value.Items()) {
+			pair := item.(List)
+			key, ok := pair[0].(string)
+			if !ok {
+				return FmtError(
+					"JSON object keys must be strings, got:",
+					pair[0])
+			} else if i > 0 {
+				out.WriteByte(',')
+			}
+			writeJSONString(out, key)
+			out.WriteByte(':')
+			err := self.writeJSON(out, pair[1], depth + 1)
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case Closure:
+		return Error{Data: "Can't convert a function to JSON."}
+	case Builtin:
+		return Error{Data: "Can't convert a procedure to JSON."}
+	default:
+		return FmtError("Can't convert to JSON:", value)
+	}
+	return self.fitString(out.Len())
+}
+
+func writeJSONString(out *strings.Builder, text string) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(text)
+	out.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// ParseJSON decodes JSON text into lists, dictionaries, strings, numbers,
+// booleans and nil. Numbers are integers if they look like ones, same as
+// in code, and floats otherwise.
+func ParseJSON(text string) (interface{}, error) {
+	return (&Interpreter{}).parseJSON(text)
+}
+
+// parseJSON is ParseJSON, except lists and dictionaries must be within
+// the limits of the interpreter.
+func (self *Interpreter) parseJSON(text string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	value, err := self.readJSON(dec)
+	if err != nil {
+		return nil, err
+	} else if _, err := dec.Token(); err != io.EOF {
+		return nil, Error{Data: "Bad JSON: extra data after value."}
+	}
+	return value, nil
+}
+
+func (self *Interpreter) readJSON(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err == io.EOF {
+		return nil, Error{Data: "Bad JSON: unexpected end of input."}
+	} else if err != nil {
+		return nil, badJSON(err)
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '[' {
+			list := List{}
+			for dec.More() {
+				if err := self.fitList(len(list) + 1); err != nil {
+					return nil, err
+				}
+				item, err := self.readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, badJSON(err)
+			}
+			return list, nil
+		} else {
+			dict := &Dict{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, badJSON(err)
+				}
+				value, err := self.readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				dict.Put(key, value)
+				if err := self.fitDict(dict.Len()); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, badJSON(err)
+			}
+			return dict, nil
+		}
+	case json.Number:
+		if intre.MatchString(string(token)) {
+			if value, err := strconv.Atoi(string(token)); err == nil {
+				return value, nil
+			}
+		}
+		value, err := strconv.ParseFloat(string(token), 64)
+		if err != nil {
+			return nil, badJSON(err)
+		}
+		return value, nil
+	default:
+		// Strings, booleans and null come out just right.
+		return token, nil
+	}
+}
+
+func badJSON(err error) error {
+	return Error{Data: "Bad JSON: " + err.Error()}
+}
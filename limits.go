@@ -0,0 +1,202 @@
+package lunar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrBudget is the error code gets when it runs out of steps. Like the
+// errors of a cancelled context, it stops a script for good: catch won't
+// trap it, so hosts can tell with errors.Is once Run and friends return.
+var ErrBudget = errors.New("Step budget exhausted.")
+
+// budget tracks the limits code is running under.
+type budget struct {
+	ctx context.Context
+	done <-chan struct{}
+	steps int
+	taken int
+}
+
+// Halted tells if an error means code was stopped from outside.
+func Halted(err error) bool {
+	return errors.Is(err, ErrBudget) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// restrict puts limits in force, returning a function to lift them.
+func (self *Interpreter) restrict(ctx context.Context, steps int) func () {
+	saved := self.budget
+	self.budget = &budget{ctx: ctx, done: ctx.Done(), steps: steps}
+	return func () {
+		self.budget = saved
+	}
+}
+
+// step counts a step against the budget, and checks the context, since
+// a single step can take a while; it's only called while there is a budget.
+func (self *Interpreter) step() error {
+	b := self.budget
+	b.taken++
+	if b.steps > 0 && b.taken > b.steps {
+		return ErrBudget
+	}
+	select {
+	case <-b.done:
+		return b.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// RunContext is like Run, but gives up when ctx is done, or after the
+// given number of steps if positive.
+func RunContext(
+	ctx context.Context, steps int, code List, scope *Scope,
+) (interface{}, error) {
+	defer scope.Interp.restrict(ctx, steps)()
+	return Run(code, scope)
+}
+
+// ResultsContext is like Results, but gives up when ctx is done, or after
+// the given number of steps if positive.
+func ResultsContext(
+	ctx context.Context, steps int, code List, scope *Scope,
+) (List, error) {
+	defer scope.Interp.restrict(ctx, steps)()
+	return Results(code, scope)
+}
+
+// LoadContext is like Load, but gives up when ctx is done, or after the
+// given number of steps if positive.
+func LoadContext(
+	ctx context.Context, steps int, fn string, s *Scope,
+) (interface{}, error) {
+	defer s.Interp.restrict(ctx, steps)()
+	return Load(fn, s)
+}
+
+// fitList checks that a list of the given size is within limits.
+func (self *Interpreter) fitList(size int) error {
+	if self.MaxList > 0 && size > self.MaxList {
+		return Error{Data: fmt.Sprintf(
+			"List of %d items exceeds the limit of %d.",
+			size, self.MaxList)}
+	}
+	return nil
+}
+
+// fitString checks that a string of the given size is within limits.
+func (self *Interpreter) fitString(size int) error {
+	return fitString(size, self.MaxString)
+}
+
+func fitString(size, limit int) error {
+	if limit > 0 && size > limit {
+		return Error{Data: fmt.Sprintf(
+			"String of %d bytes exceeds the limit of %d.", size, limit)}
+	}
+	return nil
+}
+
+// fitPrinted checks that value is within limits once printed, working it
+// out without printing it.
+func (self *Interpreter) fitPrinted(value interface{}) error {
+	if self.MaxString > 0 {
+		return self.fitString(printedSize(value, self.MaxString, 0))
+	}
+	return nil
+}
+
+// printedSize works out how long value is once printed, like ToString
+// does, giving up as soon as that's more than limit.
+func printedSize(value interface{}, limit, depth int) int {
+	if depth > maxNesting {
+		panic(Error{Data: "Data nested too deeply to print."})
+	}
+	switch value := value.(type) {
+	case string:
+		return len(value)
+	case List:
+		// Brackets around, spaces in between.
+		size := 1 + len(value)
+		if len(value) == 0 {
+			size = 2
+		}
+		for _, i := range(value) {
+			if size > limit {
+				break
+			}
+			size += printedSize(i, limit - size, depth + 1)
+		}
+		return size
+	case *Dict:
+		// Like map[k:v k:v].
+		size := len("map[]") + 2 * value.Len() - 1
+		if value.Len() == 0 {
+			size = len("map[]")
+		}
+		for _, i := range(value.entries) {
+			if size > limit {
+				break
+			} else if !i.deleted {
+				size += printedSize(i.key, limit - size, depth + 1)
+				size += printedSize(i.value, limit - size, depth + 1)
+			}
+		}
+		return size
+	case Closure:
+		return len("fn  do  end") +
+			printedSize(StringList(value.Arglist), limit, depth + 1) +
+			printedSize(value.Code, limit, depth + 1)
+	default:
+		return len(fmt.Sprint(value))
+	}
+}
+
+// split is Split, except it checks the result fits before making it.
+func (self *Interpreter) split(word string) (List, error) {
+	words := split(word, self.listCap())
+	if err := self.fitList(len(words)); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+// listCap is how many items a list can have and still go one past the
+// limit, which is enough to tell it's too long; -1 if there's no limit.
+// That's what functions like strings.SplitN expect to be told.
+func (self *Interpreter) listCap() int {
+	if self.MaxList > 0 {
+		return self.MaxList + 1
+	} else {
+		return -1
+	}
+}
+
+// fitDict checks that a dictionary of the given size is within limits.
+func (self *Interpreter) fitDict(size int) error {
+	if self.MaxDict > 0 && size > self.MaxDict {
+		return Error{Data: fmt.Sprintf(
+			"Dictionary of %d keys exceeds the limit of %d.",
+			size, self.MaxDict)}
+	}
+	return nil
+}
+
+// join is strings.Join, except it checks the result fits before making it.
+func (self *Interpreter) join(words []string, sep string) (string, error) {
+	if self.MaxString > 0 && len(words) > 0 {
+		size := len(sep) * (len(words) - 1)
+		for _, i := range(words) {
+			size += len(i)
+		}
+		if err := self.fitString(size); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(words, sep), nil
+}
@@ -0,0 +1,184 @@
+package lunar
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const forever = `while [true] do make x 1 end`
+
+func TestBudget(t *testing.T) {
+	interp := NewInterpreter()
+	code := parseScript(t, interp, forever)
+	_, err := RunContext(context.Background(), 1000, code, interp.Toplevel)
+	if !errors.Is(err, ErrBudget) || !Halted(err) {
+		t.Fatalf("got %v, want %v", err, ErrBudget)
+	}
+	// The budget only lasts for the one run.
+	if _, err := try(interp, `make y 1`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	interp := NewInterpreter()
+	code := parseScript(t, interp, forever)
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 20 * time.Millisecond)
+	defer cancel()
+	_, err := ResultsContext(ctx, 0, code, interp.Toplevel)
+	if !errors.Is(err, context.DeadlineExceeded) || !Halted(err) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = RunContext(ctx, 0, code, interp.Toplevel)
+	if !errors.Is(err, context.Canceled) || !Halted(err) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+// Scripts mustn't be able to keep running once halted.
+func TestHaltUncaught(t *testing.T) {
+	interp := NewInterpreter()
+	for _, src := range([]string{
+		`catch e do ` + forever + ` end`,
+		`while [true] do catch e do ` + forever + ` end end`,
+		`function "f" [] do catch e do f end end f`,
+	}) {
+		code := parseScript(t, interp, src)
+		_, err := RunContext(
+			context.Background(), 10000, code, interp.Toplevel)
+		if !errors.Is(err, ErrBudget) {
+			t.Errorf("%s: got %v, want %v", src, err, ErrBudget)
+		}
+	}
+}
+
+func TestNotHalted(t *testing.T) {
+	_, err := try(NewInterpreter(), `throw "oops"`)
+	if err == nil || Halted(err) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestMaxList(t *testing.T) {
+	interp := NewInterpreter()
+	interp.MaxList = 10
+	for _, src := range([]string{
+		`iseq 1 11`,
+		`array 11`,
+		`split "a b c d e f g h i j k"`,
+		`split-by "," "a,b,c,d,e,f,g,h,i,j,k"`,
+		`re-split "," "a,b,c,d,e,f,g,h,i,j,k"`,
+		`match-all "." "abcdefghijk"`,
+		`concat iseq 1 5 iseq 1 6`,
+		`lput 11 iseq 1 10`,
+		`fput 0 iseq 1 10`,
+		`parse-json "[1,2,3,4,5,6,7,8,9,10,11]"`,
+	}) {
+		checkLimit(t, interp, src, "List of")
+	}
+	if _, err := try(interp, `iseq 1 10`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxString(t *testing.T) {
+	interp := NewInterpreter()
+	interp.MaxString = 10
+	for _, src := range([]string{
+		`word "abcdef" "ghijk"`,
+		`join iseq 1 10`,
+		`join-by "," [a b c d e f]`,
+		`to-string iseq 1 10`,
+		`to-json iseq 1 10`,
+		`format "%20d" [1]`,
+		`re-replace "." "abcdef" "xx"`,
+	}) {
+		checkLimit(t, interp, src, "String of")
+	}
+	if _, err := try(interp, `word "abcde" "fghij"`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxDict(t *testing.T) {
+	interp := NewInterpreter()
+	interp.MaxDict = 3
+	for _, src := range([]string{
+		`dict [a 1 b 2 c 3 d 4]`,
+		`make d dict [a 1 b 2 c 3] put :d "e" 5`,
+		`parse-json "{\"a\":1,\"b\":2,\"c\":3,\"d\":4}"`,
+	}) {
+		checkLimit(t, interp, src, "Dictionary of")
+	}
+	if _, err := try(interp, `dict [a 1 b 2 c 3]`); err != nil {
+		t.Error(err)
+	}
+}
+
+func parseScript(t *testing.T, interp *Interpreter, src string) List {
+	t.Helper()
+	code, err := interp.ParseTokens(Tokenize(src, Pos{Line: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// checkLimit expects src to run into a limit, with an error that scripts
+// can catch, unlike a halt.
+func checkLimit(t *testing.T, interp *Interpreter, src, want string) {
+	t.Helper()
+	_, err := try(interp, src)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("%s: got %v, want %s...", src, err, want)
+	} else if Halted(err) {
+		t.Errorf("%s: halted", src)
+	}
+	got, err := try(interp, `catch e do ` + src + ` end :e`)
+	if err != nil {
+		t.Errorf("%s: uncaught %v", src, err)
+	} else if !strings.Contains(ToString(got[len(got) - 1]), want) {
+		t.Errorf("%s: caught %s", src, ToString(got))
+	}
+}
+
+// endless is input that never ends, nor has a line break.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range(p) {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+// Reading must stop at the limit, not once everything has been read.
+func TestMaxStringInput(t *testing.T) {
+	interp := NewInterpreter()
+	interp.MaxString = 10000
+	interp.Ins = endless{}
+	for _, src := range([]string{`read-all`, `readword`, `readlist`}) {
+		checkLimit(t, interp, src, "String of")
+	}
+	interp.Allow("filesystem")
+	if _, err := os.Stat("/dev/zero"); err == nil {
+		checkLimit(t, interp, `read-file "/dev/zero"`, "String of")
+		checkLimit(t, interp, `read-lines "/dev/zero"`, "String of")
+	}
+	interp.MaxString = 5
+	interp.Ins = strings.NewReader("abcde\r\nabcdef\nabc")
+	got, err := try(interp, `readword catch e do readword end readword`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[abcde <nil> abc]"; ToString(got) != want {
+		t.Errorf("got %s, want %s", ToString(got), want)
+	}
+}
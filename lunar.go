@@ -1,23 +1,26 @@
-// Lunar Logo: clean, minimal scripting language based on Logo and Lua.
-package main
+// Package lunar implements Lunar Logo, a clean, minimal scripting language
+// based on Logo and Lua.
+package lunar
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"strconv"
 	"regexp"
+	"io"
 	"os"
 	"bufio"
 	"sort"
 	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
+	"weak"
 )
 
-var Ins = os.Stdin
-var Outs = os.Stdout
-var Errs = os.Stderr
-
 var intre = regexp.MustCompile(`^-?[[:digit:]]+$`)
 var splitre = regexp.MustCompile(`[[:space:]]+`)
 var spacere = regexp.MustCompile(`^[[:space:]]+$`)
@@ -26,16 +29,83 @@ var alphare = regexp.MustCompile(`^[[:alpha:]]+$`)
 var alnumre = regexp.MustCompile(`^[[:alnum:]]+$`)
 
 type List []interface{}
-type Dict map[interface{}]interface{}
+
+// Interpreter owns the state of a program: procedures, streams and globals.
+type Interpreter struct {
+	Procedures map[string]Builtin
+	Ins io.Reader
+	Outs io.Writer
+	Errs io.Writer
+	Rand *rand.Rand
+	Toplevel *Scope
+	// MaxDepth limits how deeply calls to functions and procedures can
+	// nest; 0 means no limit.
+	MaxDepth int
+	// MaxList, MaxString and MaxDict limit how many items a list,
+	// bytes a string and keys a dictionary made by a script can have;
+	// again, 0 means no limit.
+	MaxList int
+	MaxString int
+	MaxDict int
+	
+	depth int
+	budget *budget
+	input *Stream
+	inputOf io.Reader
+	patterns map[string]*regexp.Regexp
+	stack []frame
+	vals []interface{}
+	recent [16]recent
+}
+
+// DefaultMaxDepth is the call depth new interpreters allow; it stays well
+// clear of the point where Go would abort the whole program instead.
+const DefaultMaxDepth = 10000
+
+// NewInterpreter returns an interpreter with a copy of the built-in
+// procedures, connected to the standard streams. Those in the filesystem
+// and load groups are left out, so scripts can't touch files unless
+// allowed to.
+func NewInterpreter() *Interpreter {
+	interp := &Interpreter{
+		Procedures: make(map[string]Builtin, len(Builtins)),
+		Ins: os.Stdin,
+		Outs: os.Stdout,
+		Errs: os.Stderr,
+		Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		MaxDepth: DefaultMaxDepth,
+	}
+	for name, proc := range(Builtins) {
+		interp.Procedures[name] = proc
+	}
+	for _, group := range([]string{"filesystem", "load"}) {
+		for _, name := range(Groups[group]) {
+			delete(interp.Procedures, name)
+		}
+	}
+	interp.Toplevel = &Scope{
+		Names: map[string]interface{}{}, Interp: interp}
+	return interp
+}
 
 type Scope struct {
 	Names map[string]interface{}
 	Parent *Scope
+	Interp *Interpreter
 	
 	continuing bool
 	breaking bool
 	returning bool
 	
+	function bool // set on the locals of a function call
+	tail *tailcall // the call to make in place of returning, if any
+	
+	// The locals of a function call start out as just its arguments,
+	// named by arglist, and Names is only made once something needs it.
+	arglist []string
+	args []interface{}
+	argv [2]interface{} // room for args, saving a separate allocation
+	
 	test *bool
 }
 
@@ -48,191 +118,712 @@ type Closure struct {
 	Arglist []string
 	Code List
 	*Scope
+	Name string
 }
 
 type Error struct {
 	Data interface{}
+	Pos Pos
+	Stack []Frame
 }
 
 func (self Error) Error() string {
-	return fmt.Sprint(self.Data)
+	data := printableData(self.Data)
+	if self.Pos.IsValid() {
+		return fmt.Sprintf("%v: %v", self.Pos, data)
+	} else {
+		return fmt.Sprint(data)
+	}
 }
 
+// Unwrap gives access to the Go error underlying a Lunar one, if any.
+func (self Error) Unwrap() error {
+	if err, ok := self.Data.(error); ok {
+		return err
+	} else {
+		return nil
+	}
+}
 func FmtError(msg string, data interface{}) Error {
-	return Error{fmt.Sprintf("%s %v", msg, data)}
+	return Error{Data: fmt.Sprintf("%s %v", msg, printableData(data))}
+}
+
+// Pos tells where a word was read from; the zero value means unknown.
+type Pos struct {
+	File string
+	Line int
+	Column int
+}
+
+func (self Pos) IsValid() bool {
+	return self.Line > 0
+}
+
+func (self Pos) String() string {
+	return fmt.Sprintf("%s:%d:%d", self.File, self.Line, self.Column)
+}
+
+// Frame is a function or procedure call on the stack, and where it was made.
+type Frame struct {
+	Name string
+	Pos Pos
+}
+
+func (self Frame) String() string {
+	if self.Pos.IsValid() {
+		return fmt.Sprintf("%s (%v)", self.Name, self.Pos)
+	} else {
+		return self.Name
+	}
+}
+
+// frame is how the interpreter tracks calls, resolving details lazily.
+type frame struct {
+	prog *program
+	pc int32
+	name string
+}
+
+// Token is a word of source code along with its position. Quoted tokens
+// are string literals, and keep their quotes and escapes until parsed.
+type Token struct {
+	Word string
+	Pos
+	Quoted bool
+}
+
+// Tokenize splits text into words, starting from the given position.
+// Square brackets are words on their own, even without spaces around them;
+// string literals go from a double quote to the next one on the same line.
+func Tokenize(text string, pos Pos) []Token {
+	return tokenize(text, pos, true)
+}
+
+// tokenize is like Tokenize, except spaces only separate words if split is
+// set, since a word from the command line may contain them.
+func tokenize(text string, pos Pos, split bool) []Token {
+	tokens := make([]Token, 0)
+	word := make([]rune, 0)
+	start := pos
+	quoted := false
+	escaped := false
+	flush := func () {
+		if len(word) > 0 {
+			tokens = append(tokens, Token{
+				Word: string(word), Pos: start, Quoted: quoted})
+			word = word[:0]
+		}
+		quoted = false
+	}
+	for _, r := range(text) {
+		if quoted && r != '\n' {
+			word = append(word, r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == '"' {
+				flush()
+			}
+		} else if strings.ContainsRune(" \t\n\v\f\r", r) {
+			if split || r == '\n' {
+				flush()
+			} else {
+				word = append(word, r)
+			}
+		} else if r == '[' || r == ']' {
+			flush()
+			tokens = append(tokens, Token{Word: string(r), Pos: pos})
+		} else if len(word) == 0 {
+			start = pos
+			quoted = r == '"'
+			word = append(word, r)
+		} else {
+			word = append(word, r)
+		}
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// PosAt returns the position of the item at cursor in code, if known.
+func (self *Interpreter) PosAt(code List, cursor int) Pos {
+	if pos := positions(code); cursor >= 0 && cursor < len(pos) {
+		return pos[cursor]
+	} else {
+		return Pos{}
+	}
+}
+
+// codeInfo is what the interpreter knows about a list of code. It's kept
+// in codeTable, apart from the list, so that neither scripts nor hosts can
+// get at it or overwrite it, but slices of the same list find it too. It
+// must not refer back to the list, or the list would never go away.
+type codeInfo struct {
+	end weak.Pointer[interface{}] // the last item the list has room for
+	size int // the capacity of the list, to find where slices start
+	pos []Pos
+	// Which items were string literals, which stand for themselves even
+	// if they look like a variable, keyword or function name. They're
+	// plain strings otherwise, so scripts can use code as data.
+	quoted []bool
+	prog atomic.Pointer[program]
+	parsed atomic.Pointer[parsing]
+}
+
+// codeTable holds the codeInfo of lists by the address of their last item
+// of capacity, which all slices of a list share; since the address may be
+// reused once the list is gone, each entry checks it's still the same.
+var codeTable = struct {
+	sync.RWMutex
+	infos map[uintptr]*codeInfo
+	swept int // how many entries there were after sweeping
+}{infos: make(map[uintptr]*codeInfo)}
+
+// endOf returns the last item code has room for, if any, and its address.
+func endOf(code List) (*interface{}, uintptr) {
+	if cap(code) == 0 {
+		return nil, 0
+	}
+	end := &code[:cap(code)][cap(code) - 1]
+	return end, uintptr(unsafe.Pointer(end))
+}
+
+// infoOf returns the information kept about code, if any.
+func infoOf(code List) *codeInfo {
+	end, key := endOf(code)
+	if end == nil {
+		return nil
+	}
+	codeTable.RLock()
+	info := codeTable.infos[key]
+	codeTable.RUnlock()
+	if info == nil || info.end.Value() != end {
+		return nil
+	}
+	return info
+}
+
+// offsetOf returns where code starts in the list its info is about.
+func (self *codeInfo) offsetOf(code List) int {
+	return self.size - cap(code)
+}
+
+// positions returns where the items of code were read from, if known.
+func positions(code List) []Pos {
+	info := infoOf(code)
+	if info == nil {
+		return nil
+	}
+	start := info.offsetOf(code)
+	if start + len(code) > len(info.pos) {
+		return nil
+	}
+	return info.pos[start:start + len(code)]
+}
+
+// literals tells which items of code were string literals; nil if none.
+func literals(code List) []bool {
+	info := infoOf(code)
+	if info == nil {
+		return nil
+	}
+	start := info.offsetOf(code)
+	if start + len(code) > len(info.quoted) {
+		return nil
+	}
+	return info.quoted[start:start + len(code)]
+}
+
+// remember associates code with the positions its items were read from,
+// and which were string literals, if known.
+func remember(code List, pos []Pos, quoted []bool) List {
+	if len(code) != len(pos) {
+		pos = nil
+	}
+	if len(code) != len(quoted) || !anyTrue(quoted) {
+		quoted = nil
+	}
+	end, key := endOf(code)
+	if end == nil {
+		return code
+	}
+	info := &codeInfo{
+		end: weak.Make(end), size: cap(code), pos: pos, quoted: quoted}
+	codeTable.Lock()
+	defer codeTable.Unlock()
+	if len(codeTable.infos) >= 2 * codeTable.swept + 1024 {
+		sweepCode()
+	}
+	codeTable.infos[key] = info
+	return code
+}
+
+// sweepCode drops the entries for lists that are gone from codeTable,
+// which must be locked.
+func sweepCode() {
+	for key, i := range(codeTable.infos) {
+		if i.end.Value() == nil {
+			delete(codeTable.infos, key)
+		}
+	}
+	codeTable.swept = len(codeTable.infos)
+}
+
+func anyTrue(flags []bool) bool {
+	for _, i := range(flags) {
+		if i {
+			return true
+		}
+	}
+	return false
+}
+
+// isWord tells if the item at cursor in code is the given keyword, rather
+// than a string literal that looks like it.
+func isWord(code List, quoted []bool, cursor int, word string) bool {
+	return code[cursor] == word && (quoted == nil || !quoted[cursor])
+}
+
+// locate gives err the position of the item at cursor in code, unless
+// it already has one; errors from outside the language are wrapped.
+func (self *Interpreter) locate(err error, code List, cursor int) error {
+	if err == nil { return nil }
+	return placed(err, self.PosAt(code, cursor))
+}
+
+// placed gives err the given position, like locate.
+func placed(err error, pos Pos) error {
+	if err == nil { return nil }
+	switch e := err.(type) {
+	case Error:
+		if !e.Pos.IsValid() {
+			e.Pos = pos
+		}
+		return e
+	default:
+		if pos.IsValid() {
+			return Error{Data: err, Pos: pos}
+		} else {
+			return err
+		}
+	}
+}
+
+// trace gives err a copy of the call stack, unless it already has one.
+func (self *Interpreter) trace(err error) error {
+	if err == nil || len(self.stack) == 0 { return err }
+	e, ok := err.(Error)
+	if !ok {
+		e = Error{Data: err}
+	} else if e.Stack != nil {
+		return e
+	}
+	e.Stack = make([]Frame, len(self.stack))
+	for i, f := range(self.stack) {
+		e.Stack[i].Name = f.name
+		if f.prog == nil {
+			continue
+		}
+		ins := &f.prog.code[f.pc]
+		e.Stack[i].Pos = f.prog.posAt(ins.at)
+		if f.name == "" {
+			e.Stack[i].Name = self.nameOf(f.prog.procs[ins.arg])
+		}
+	}
+	return e
+}
+
+// nameOf finds the name a built-in procedure goes by.
+func (self *Interpreter) nameOf(proc Builtin) string {
+	code := reflect.ValueOf(proc.Code).Pointer()
+	for name, i := range(self.Procedures) {
+		if reflect.ValueOf(i.Code).Pointer() == code {
+			return name
+		}
+	}
+	return "?"
+}
+
+// errorData returns what an error carries, sans position, for catch.
+func errorData(err interface{}) string {
+	if e, ok := err.(Error); ok {
+		return fmt.Sprint(printableData(e.Data))
+	} else {
+		return fmt.Sprint(err)
+	}
 }
 
 func (self List) Len() int { return len(self) }
 func (self List) Swap(a, b int) { self[a], self[b] = self[b], self[a] }
 func (self List) Less(a, b int) bool {
-	switch item1 := self[a].(type) {
+	return less(self[a], self[b], 0)
+}
+
+func less(a, b interface{}, depth int) bool {
+	if depth > maxNesting {
+		panic(Error{Data: "Data nested too deeply to compare."})
+	}
+	switch item1 := a.(type) {
 	case bool:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case bool: return (!item1) && item2
-			default: panic(Error{fmt.Sprintf(
+			default: panic(Error{Data: fmt.Sprintf(
 				"Can't compare %T to %T.", item1, item2)})
 		}
 	case int:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case int: return item1 < item2
 			case float64: return float64(item1) < item2
-			default: panic(Error{fmt.Sprintf(
+			default: panic(Error{Data: fmt.Sprintf(
 				"Can't compare %T to %T.", item1, item2)})
 		}
 	case float64:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case int: return item1 < float64(item2)
 			case float64: return item1 < item2
-			default: panic(Error{fmt.Sprintf(
+			default: panic(Error{Data: fmt.Sprintf(
 				"Can't compare %T to %T.", item1, item2)})
 		}
 	case string:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case string: return item1 < item2
-			default: panic(Error{fmt.Sprintf(
+			default: panic(Error{Data: fmt.Sprintf(
 				"Can't compare %T to %T.", item1, item2)})
 		}
+	case List:
+		// Compare item by item, then shorter lists go first.
+		switch item2 := b.(type) {
+		case List:
+			for i := 0; i < len(item1) && i < len(item2); i++ {
+				if less(item1[i], item2[i], depth + 1) {
+					return true
+				} else if less(item2[i], item1[i], depth + 1) {
+					return false
+				}
+			}
+			return len(item1) < len(item2)
+		default: panic(Error{Data: fmt.Sprintf(
+			"Can't compare %T to %T.", item1, item2)})
+		}
 	default:
-		panic(Error{fmt.Sprintf(
+		panic(Error{Data: fmt.Sprintf(
 			"No comparisons defined on %T.", item1)})
 	}
 }
 
 // Equal complements sort.Interface to enable all comparison operators.
+// Lists and dictionaries are equal if their contents are, in any order
+// for the latter.
 func (self List) Equal(a, b int) bool {
-	if self[a] == nil && self[b] == nil { return true }
-	if self[a] == nil || self[b] == nil { return false }
-	switch item1 := self[a].(type) {
+	return equal(self[a], self[b], 0)
+}
+
+func equal(a, b interface{}, depth int) bool {
+	if a == nil && b == nil { return true }
+	if a == nil || b == nil { return false }
+	if depth > maxNesting {
+		panic(Error{Data: "Data nested too deeply to compare."})
+	}
+	switch item1 := a.(type) {
 	case int:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case int: return item1 == item2
 			case float64: return float64(item1) == item2
-			default: panic(Error{fmt.Sprintf(
-				"Can't compare %T to %T.", item1, item2)})
+			default: return mismatch(item1, item2, depth)
 		}
 	case float64:
-		switch item2 := self[b].(type) {
+		switch item2 := b.(type) {
 			case int: return item1 == float64(item2)
 			case float64: return item1 == item2
-			default: panic(Error{fmt.Sprintf(
-				"Can't compare %T to %T.", item1, item2)})
+			default: return mismatch(item1, item2, depth)
+		}
+	case List:
+		item2, ok := b.(List)
+		if !ok || len(item1) != len(item2) {
+			return false
+		} else if len(item1) > 0 && &item1[0] == &item2[0] {
+			return true
+		}
+		for i := range(item1) {
+			if !equal(item1[i], item2[i], depth + 1) {
+				return false
+			}
 		}
+		return true
+	case *Dict:
+		item2, ok := b.(*Dict)
+		if !ok || item1.Len() != item2.Len() {
+			return false
+		} else if item1 == item2 {
+			return true
+		}
+		for _, i := range(item1.Items()) {
+			pair := i.(List)
+			value, ok := item2.Get(pair[0])
+			if !ok || !equal(pair[1], value, depth + 1) {
+				return false
+			}
+		}
+		return true
+	case Closure:
+		item2, ok := b.(Closure)
+		return ok && sameClosure(item1, item2)
+	case Builtin:
+		item2, ok := b.(Builtin)
+		return ok && item1.Arity == item2.Arity &&
+			reflect.ValueOf(item1.Code).Pointer() ==
+				reflect.ValueOf(item2.Code).Pointer()
 	default:
-		return self[a] == self[b]
+		// Go can't compare everything, so that's left to identity.
+		if t := reflect.TypeOf(a); t != reflect.TypeOf(b) ||
+			!t.Comparable() {
+			return false
+		}
+		return a == b
 	}
 }
 
+// mismatch is what equal makes of values it can't compare: an error for
+// eq and friends, but just unequal inside lists and dictionaries, the
+// same as telling them apart by key.
+func mismatch(a, b interface{}, depth int) bool {
+	if depth == 0 {
+		panic(Error{Data: fmt.Sprintf("Can't compare %T to %T.", a, b)})
+	}
+	return false
+}
+
+// sameClosure tells if two closures are the same function, made by the
+// same fn or function, in the same scope.
+func sameClosure(a, b Closure) bool {
+	if a.Scope != b.Scope || a.Name != b.Name ||
+		len(a.Code) != len(b.Code) ||
+		len(a.Arglist) != len(b.Arglist) {
+		return false
+	} else if len(a.Code) > 0 && &a.Code[0] != &b.Code[0] {
+		return false
+	}
+	for i := range(a.Arglist) {
+		if a.Arglist[i] != b.Arglist[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (self *Scope) Get(name string) (interface{}, error) {
-	if value, ok := self.Names[name]; ok {
-		return value, nil
-	} else if self.Parent != nil {
-		return self.Parent.Get(name)
-	} else {
-		return nil, Error{"Undefined variable: " + name}
+	for s := self; s != nil; s = s.Parent {
+		if value, ok := s.lookup(name); ok {
+			return value, nil
+		}
 	}
+	return nil, Error{Data: "Undefined variable: " + name}
 }
 
 func (self *Scope) SafeGet(name string, fallback interface{}) interface{} {
-	if value, ok := self.Names[name]; ok {
-		return value
-	} else if self.Parent != nil {
-		return self.Parent.SafeGet(name, fallback)
-	} else {
-		return fallback
+	for s := self; s != nil; s = s.Parent {
+		if value, ok := s.lookup(name); ok {
+			return value
+		}
 	}
+	return fallback
 }
 
 func (self *Scope) Put(name string, value interface{}) {
+	s := self
+	for !s.assign(name, value) {
+		if s.Parent == nil {
+			s.vars()[name] = value
+			return
+		}
+		s = s.Parent
+	}
+}
+
+// lookup finds a variable in this scope alone.
+func (self *Scope) lookup(name string) (interface{}, bool) {
+	for i := len(self.arglist) - 1; i >= 0; i-- {
+		if self.arglist[i] == name {
+			return self.args[i], true
+		}
+	}
+	value, ok := self.Names[name]
+	return value, ok
+}
+
+// assign changes a variable in this scope alone, if it's there.
+func (self *Scope) assign(name string, value interface{}) bool {
+	for i := len(self.arglist) - 1; i >= 0; i-- {
+		if self.arglist[i] == name {
+			self.args[i] = value
+			return true
+		}
+	}
 	if _, ok := self.Names[name]; ok {
 		self.Names[name] = value
-	} else if self.Parent != nil {
-		self.Parent.Put(name, value)
-	} else {
-		self.Names[name] = value
+		return true
 	}
+	return false
 }
 
-func (self *Closure) Apply(args ...interface{})  (interface{}, error) {
-	locals := Scope{Names: map[string]interface{}{}, Parent: self.Scope}
-	if len(self.Arglist) != len(args) {
-		return nil, Error{fmt.Sprintf(
-			"%d arguments passed to function expecting %d.",
-			len(args), len(self.Arglist))}
+// vars returns Names, first making it out of the arguments if need be.
+// Anything that writes to Names directly must get it from here.
+func (self *Scope) vars() map[string]interface{} {
+	if self.Names == nil {
+		self.Names = make(map[string]interface{}, len(self.arglist))
+		for i, name := range(self.arglist) {
+			self.Names[name] = self.args[i]
+		}
+		self.arglist, self.args = nil, nil
 	}
-	for i, n := range(self.Arglist) {
-		locals.Names[n] = args[i]
+	return self.Names
+}
+
+// Reset clears any pending break, continue or return, so that the scope
+// can go on running code, as in an interactive session.
+func (self *Scope) Reset() {
+	self.continuing = false
+	self.breaking = false
+	self.returning = false
+	self.tail = nil
+}
+
+func (self *Closure) Apply(args ...interface{})  (interface{}, error) {
+	return self.call(nil, 0, args...)
+}
+
+// call applies the closure as called from the instruction at pc in prog,
+// if any, for tracing.
+// A function that ends with return followed by another function call
+// hands that call back here, so tail recursion doesn't grow the Go stack.
+func (self *Closure) call(
+	prog *program, pc int, args ...interface{}) (interface{}, error) {
+	interp := self.Interp
+	closure := *self
+	for {
+		if len(closure.Arglist) != len(args) {
+			return nil, Error{Data: fmt.Sprintf(
+				"%d arguments passed to function expecting %d.",
+				len(args), len(closure.Arglist))}
+		}
+		locals := Scope{
+			Parent: closure.Scope,
+			Interp: closure.Interp,
+			function: true,
+			arglist: closure.Arglist}
+		if len(args) <= len(locals.argv) {
+			locals.args = locals.argv[:len(args)]
+		} else {
+			locals.args = make(List, len(args))
+		}
+		copy(locals.args, args)
+		name := closure.Name
+		if name == "" {
+			name = "fn"
+		}
+		if interp.MaxDepth > 0 && interp.depth >= interp.MaxDepth {
+			return nil, Error{Data: "Stack depth exceeded in " + name}
+		}
+		interp.depth++
+		interp.stack = append(interp.stack,
+			frame{prog: prog, pc: int32(pc), name: name})
+		value, err := Run(closure.Code, &locals)
+		err = interp.trace(err)
+		interp.stack = interp.stack[:len(interp.stack) - 1]
+		interp.depth--
+		if err != nil || locals.tail == nil {
+			return value, err
+		}
+		tail := locals.tail
+		closure, args = tail.closure, tail.args
+		prog, pc = tail.prog, tail.pc
 	}
-	return Run(self.Code, &locals)
 }
 
 func (self Closure) String() string {
 	return fmt.Sprintf("fn %v do %v end", self.Arglist, self.Code)
 }
 
-func EvalNext(code List, cursor int, scope *Scope) (interface{}, int, error) {
-	collectArgs := func (num int, msg string) (List, error) {
-		args := make(List, num)
-		for i := 0; i < num; i++ {
-			if cursor >= len(code) {
-				return args, Error{msg}
-			}
-			tmp, csr, err := EvalNext(code, cursor, scope)
-			if err != nil {
-				return args, err
-			}
-			args[i] = tmp
-			cursor = csr
-		}
-		return args, nil
+// Call invokes the procedure, turning any panic into an error.
+func (self Builtin) Call(s *Scope, a ...interface{}) (v interface{}, e error) {
+	if s != nil && !isOwn(self) {
+		s.vars()
 	}
-	
-	value := code[cursor]
-	
-	switch value := value.(type) {
-	case Builtin:
-		cursor++
-		args, err := collectArgs(value.Arity, "Not enough arguments.")
-		if err != nil {
-			return nil, cursor, err
-		}
-		tmp, err := value.Code(scope, args...)
-		return tmp, cursor, err
-	case string:
-		if value[0] == ':' {
-			// Expect name to be already lowercased.
-			tmp, err := scope.Get(value[1:])
-			return tmp, cursor + 1, err
-		} else if value == "do" {
-			return ScanBlock(code, cursor + 1)
-		} else {
-			closure := scope.SafeGet(
-				strings.ToLower(value), value)
-			if closure, ok := closure.(Closure); ok {
-				cursor++
-				args, err := collectArgs(
-					len(closure.Arglist),
-					"Not enough arguments to " +
-						strings.ToLower(value))
-				if err != nil {
-					return nil, cursor, err
-				}
-				tmp, err := closure.Apply(args...)
-				return tmp, cursor, err
+	defer func () {
+		if err := recover(); err != nil {
+			if data, ok := err.(Error); ok {
+				v, e = nil, data
 			} else {
-				return value, cursor + 1, nil
+				v, e = nil, Error{Data: fmt.Sprint(err)}
 			}
 		}
-	default:
-		return value, cursor + 1, nil
+	}()
+	return self.Code(s, a...)
+}
+
+// EvalNext evaluates the expression at cursor in code, returning its value
+// and where the next one starts.
+func EvalNext(code List, cursor int, scope *Scope) (
+	value interface{}, next int, err error) {
+	if cursor < 0 || cursor >= len(code) {
+		return nil, cursor, Error{Data: "Nothing to evaluate."}
+	}
+	interp := scope.Interp
+	prog := interp.program(code)
+	pc := sort.Search(len(prog.code), func (i int) bool {
+		return int(prog.code[i].at) >= cursor
+	})
+	start := 0
+	if pc == len(prog.code) || int(prog.code[pc].at) != cursor {
+		// The cursor is inside a block, so that's not compiled yet.
+		prog, pc, start = interp.compile(code[cursor:]), 0, cursor
+	}
+	saved := interp.mark()
+	at := int32(0)
+	defer func () {
+		if e := recover(); e != nil {
+			err = interp.unwind(e, saved, prog, at)
+			value = nil
+		}
+	}()
+	value, pc, err = interp.eval(prog, pc, scope, &at)
+	if pc < len(prog.code) {
+		next = start + int(prog.code[pc].at)
+	} else {
+		next = len(code)
 	}
-	return nil, 0, nil
+	return value, next, err
+}
+
+// ScanBlock gathers code up to the matching end into a list of its own,
+// which keeps track of source positions like the original.
+func (self *Interpreter) ScanBlock(code List, cursor int) (List, int, error) {
+	return self.scanBlock(code, positions(code), literals(code), cursor)
 }
 
-func ScanBlock(code List, cursor int) (List, int, error) {
+func (self *Interpreter) scanBlock(code List, pos []Pos, quoted []bool,
+	cursor int) (List, int, error) {
+	start := cursor - 1
 	block := make(List, 0, len(code) - cursor)
-	for code[cursor] != "end" {
-		if code[cursor] == "do" {
-			tmp, csr, err := ScanBlock(code, cursor + 1)
+	where := make([]Pos, 0, len(pos))
+	lits := make([]bool, 0, len(quoted))
+	for cursor < len(code) && !isWord(code, quoted, cursor, "end") {
+		if pos != nil {
+			where = append(where, pos[cursor])
+		}
+		if quoted != nil {
+			lits = append(lits, quoted[cursor])
+		}
+		if isWord(code, quoted, cursor, "do") {
+			tmp, csr, err := self.scanBlock(
+				code, pos, quoted, cursor + 1)
 			if err != nil {
 				return block, csr, err
 			}
@@ -242,44 +833,101 @@ func ScanBlock(code List, cursor int) (List, int, error) {
 			block = append(block, code[cursor])
 			cursor++
 		}
-		if cursor >= len(code) {
-			return block, cursor, Error{
-				"Unexpected end of input in block."}
-		}
 	}
-	return block, cursor + 1, nil
+	if cursor >= len(code) {
+		return block, cursor, Error{
+			Data: "Unexpected end of input in block.",
+			Pos: self.PosAt(code, start)}
+	}
+	return remember(block, where, lits), cursor + 1, nil
 }
 
 func Parse(words []string, context map[string]Builtin) (List, error) {
-	code := make([]interface{}, 0, len(words))
-	var buf List = nil
-	in_list := false
-	for _, i := range(words) {
+	tokens := make([]Token, 0, len(words))
+	for _, word := range(words) {
+		tokens = append(tokens, tokenize(word, Pos{}, false)...)
+	}
+	code, _, quoted, err := parse(tokens, context)
+	return remember(code, nil, quoted), err
+}
+
+// ParseTokens is like Parse, but remembers where the code came from.
+func (self *Interpreter) ParseTokens(tokens []Token) (List, error) {
+	code, pos, quoted, err := parse(tokens, self.Procedures)
+	return remember(code, pos, quoted), err
+}
+
+// parseWords parses a literal list as code, like Parse, except string
+// literals in the list stay that way.
+func (self *Interpreter) parseWords(words List) (List, error) {
+	code, _, lits, err := parse(wordTokens(words, nil), self.Procedures)
+	return remember(code, nil, lits), err
+}
+
+// wordTokens turns the items of a literal list back into tokens, with
+// brackets around nested lists rather than the lists printed out.
+func wordTokens(words List, tokens []Token) []Token {
+	quoted := literals(words)
+	for i, word := range(words) {
+		if quoted != nil && quoted[i] {
+			tokens = append(tokens, Token{
+				Word: strconv.Quote(ToString(word)), Quoted: true})
+		} else if list, ok := word.(List); ok {
+			tokens = append(tokens, Token{Word: "["})
+			tokens = wordTokens(list, tokens)
+			tokens = append(tokens, Token{Word: "]"})
+		} else {
+			tokens = append(tokens,
+				tokenize(ToString(word), Pos{}, false)...)
+		}
+	}
+	return tokens
+}
+
+func parse(tokens []Token, context map[string]Builtin) (
+	List, []Pos, []bool, error) {
+	code := make([]interface{}, 0, len(tokens))
+	pos := make([]Pos, 0, len(tokens))
+	quoted := make([]bool, 0, len(tokens))
+	cursor := 0
+	for cursor < len(tokens) {
+		t := tokens[cursor]
+		i := t.Word
 		lower := strings.ToLower(i)
-		if in_list {
-			if strings.HasSuffix(i, "]") {
-				if len(i) > 1 {
-					buf = append(buf, i[:len(i) - 1])
-				}
-				code = append(code, buf)
-				in_list = false
-			} else {
-				buf = append(buf, i)
+		cursor++
+		if t.Quoted {
+			value, err := strconv.Unquote(i)
+			if err != nil {
+				return List(code), pos, quoted, Error{
+					Data: "Bad string literal: " + i,
+					Pos: t.Pos}
 			}
-		} else if i == "[]" {
-			code = append(code, make(List, 0))
-		} else if strings.HasPrefix(i, "[") {
-			if strings.HasSuffix(i, "]") {
-				code = append(code, List{i[1:len(i) - 1]})
-			} else {
-				buf = List(make([]interface{}, 0))
-				if len(i) > 1 {
-					buf = append(buf, i[1:])
+			pos = append(pos, t.Pos)
+			quoted = append(quoted, true)
+			code = append(code, value)
+			continue
+		} else if strings.HasPrefix(i, "--") {
+			for cursor < len(tokens) {
+				if t.Line > 0 && tokens[cursor].Line != t.Line {
+					break
 				}
-				in_list = true
+				cursor++
 			}
-		} else if strings.HasPrefix(i, "--") {
-			break
+			continue
+		}
+		pos = append(pos, t.Pos)
+		quoted = append(quoted, false)
+		if i == "[" {
+			list, csr, err := parseList(tokens, cursor)
+			if err != nil {
+				return List(code), pos, quoted, err
+			}
+			code = append(code, list)
+			cursor = csr
+		} else if i == "]" {
+			return List(code), pos, quoted, Error{
+				Data: "Unexpected ] outside of a list.",
+				Pos: t.Pos}
 		} else if strings.HasPrefix(i, ":") {
 			code = append(code, lower)
 		} else if lower  == "do" || lower == "end" {
@@ -308,87 +956,109 @@ func Parse(words []string, context map[string]Builtin) (List, error) {
 			}
 		}
 	}
-	if in_list {
-		return List(code), FmtError(
-			"Unclosed list at end of line:", words)
-	} else {
-		return List(code), nil
+	return List(code), pos, quoted, nil
+}
+
+// parseList reads a literal list, which may contain others, up to the
+// matching closing bracket; the words inside are kept as they are.
+func parseList(tokens []Token, cursor int) (List, int, error) {
+	start := cursor - 1
+	list := List(make([]interface{}, 0))
+	quoted := make([]bool, 0)
+	for cursor < len(tokens) {
+		if t := tokens[cursor]; t.Quoted {
+			value, err := strconv.Unquote(t.Word)
+			if err != nil {
+				return list, cursor, Error{
+					Data: "Bad string literal: " + t.Word,
+					Pos: t.Pos}
+			}
+			list = append(list, value)
+			quoted = append(quoted, true)
+			cursor++
+			continue
+		}
+		switch tokens[cursor].Word {
+		case "[":
+			tmp, csr, err := parseList(tokens, cursor + 1)
+			if err != nil {
+				return list, csr, err
+			}
+			list = append(list, tmp)
+			quoted = append(quoted, false)
+			cursor = csr
+		case "]":
+			return remember(list, nil, quoted), cursor + 1, nil
+		default:
+			list = append(list, tokens[cursor].Word)
+			quoted = append(quoted, false)
+			cursor++
+		}
 	}
+	words := make([]string, 0)
+	for _, t := range(tokens[start:]) {
+		if t.Line != tokens[start].Line { break }
+		words = append(words, t.Word)
+	}
+	err := FmtError("Unclosed list at end of input:", words)
+	err.Pos = tokens[start].Pos
+	return list, cursor, err
 }
 
 // Run underlies most other control structures.
 func Run(code List, scope *Scope) (interface{}, error) {
-	cursor := 0
-	for cursor < len(code) {
-		value, csr, err := EvalNext(code, cursor, scope)
-		if err != nil {
-			return nil, err
-		} else if scope.continuing || scope.breaking {
-			return nil, nil
-		} else if scope.returning {
-			return value, nil
-		} else if value != nil {
-			return value, FmtError(
-				"You don't say what to do with:", value)
-		}
-		cursor = csr
-	}
-	return nil, nil
+	interp := scope.Interp
+	_, value, err := interp.exec(interp.program(code), scope, false)
+	return value, err
 }
 
 // Results underlies while, ifelse and the command line.
 func Results(code List, scope *Scope) (List, error) {
-	values := make([]interface{}, 0, len(code))
-	cursor := 0
-	for cursor < len(code) {
-		val, csr, err := EvalNext(code, cursor, scope)
-		if err != nil {
-			return List(values), err
-		} else if scope.returning {
-			return List{val}, nil
-		} else if scope.breaking || scope.continuing {
-			break
-		}
-		values = append(values, val)
-		cursor = csr
-	}
-	return List(values), nil
+	interp := scope.Interp
+	values, _, err := interp.exec(interp.program(code), scope, true)
+	return values, err
 }
 
-func Load(fn string, ctx map[string]Builtin, s *Scope) (interface{}, error) {
-	code := make([]interface{}, 0)
-	file, err := os.Open(fn)
+func Load(fn string, s *Scope) (interface{}, error) {
+	text, err := os.ReadFile(fn)
 	if err != nil { return nil, err }
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 { continue }
-		words := splitre.Split(line, -1)
-		tokens, err := Parse(words, ctx)
-		if err != nil { return nil, err }
-		code = append(code, tokens...)
-	}
-	if scanner.Err() == nil {
-		return Run(List(code), s)
-	} else {
-		return nil, scanner.Err()
-	}
+	words := Tokenize(string(text), Pos{fn, 1, 1})
+	code, err := s.Interp.ParseTokens(words)
+	if err != nil { return nil, err }
+	return Run(code, s)
 }
 
 // Catch runs some code and traps any regular error or panic in a variable.
 func Catch(varname string, code List, scope *Scope) (interface{}, error) {
 	varname = strings.ToLower(varname)
+	names := scope.vars()
+	depth := len(scope.Interp.stack)
 	defer func () {
 		if err := recover(); err != nil {
-			scope.Names[varname] = fmt.Sprint(err)
+			names[varname] = errorData(err)
+			scope.Interp.stack = scope.Interp.stack[:depth]
 		}
 	}()
 	value, err := Run(code, scope)
+	if Halted(err) {
+		return nil, err
+	}
+	if err == nil && scope.tail != nil {
+		// Errors in a tail call still belong here.
+		tail := scope.tail
+		scope.tail = nil
+		value, err = tail.closure.call(
+			tail.prog, tail.pc, tail.args...)
+		if Halted(err) {
+			return nil, err
+		} else if err != nil {
+			scope.returning = false
+		}
+	}
 	if err != nil {
-		scope.Names[varname] = err.Error()
+		names[varname] = errorData(err)
 	} else {
-		scope.Names[varname] = nil
+		names[varname] = nil
 	}
 	if scope.returning {
 		return value, nil
@@ -397,29 +1067,48 @@ func Catch(varname string, code List, scope *Scope) (interface{}, error) {
 	}
 }
 
-func PrintList(list List) {
-	fmt.Fprintln(Outs, strings.Join(StringSlice(list), " "))
+func PrintList(out io.Writer, list List) {
+	fmt.Fprintln(out, strings.Join(StringSlice(list), " "))
 }
 
-func TypeList(list List) {
-	fmt.Fprint(Outs, strings.Join(StringSlice(list), " "))
+func TypeList(out io.Writer, list List) {
+	fmt.Fprint(out, strings.Join(StringSlice(list), " "))
 }
 
-// Readword returns a line of input from stdin without any processing.
-func Readword() (string, error) {
-	scanner := bufio.NewScanner(Ins)
-	if scanner.Scan() {
-		return scanner.Text(), nil
-	} else if err := scanner.Err(); err != nil {
-		return "", err
-	} else {
-		return "", bufio.ErrFinalToken
+// Readword returns a line of input without any processing. Unless in is
+// a Stream, it reads a byte at a time, so as not to take anything past the
+// line; for reading many lines, make a Stream once with NewStream.
+func Readword(in io.Reader) (string, error) {
+	if stream, ok := in.(*Stream); ok {
+		return stream.ReadLine()
+	}
+	line := make([]byte, 0)
+	char := make([]byte, 1)
+	for {
+		n, err := in.Read(char)
+		if n > 0 && char[0] == '\n' {
+			break
+		} else if n > 0 {
+			line = append(line, char[0])
+		} else if err == io.EOF && len(line) == 0 {
+			return "", bufio.ErrFinalToken
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
 	}
+	return strings.TrimSuffix(string(line), "\r"), nil
 }
 
 // While loop.
 func While(cond, code List, scope *Scope) (interface{}, error) {
 	for {
+		if scope.Interp.budget != nil {
+			if err := scope.Interp.step(); err != nil {
+				return nil, err
+			}
+		}
 		test, err := Results(cond, scope)
 		if err != nil { return nil, err }
 		if !ToBool(test[0]) { return nil, nil }
@@ -442,9 +1131,15 @@ func While(cond, code List, scope *Scope) (interface{}, error) {
 // For loop; the variable is always treated as local.
 func For(v string, i, l, p float64, code List, s *Scope) (interface{}, error) {
 	v = strings.ToLower(v)
-	s.Names[v] = i
+	names := s.vars()
+	names[v] = i
 	if l >= i {
 		for i <= l {
+			if s.Interp.budget != nil {
+				if err := s.Interp.step(); err != nil {
+					return nil, err
+				}
+			}
 			value, err := Run(code, s)
 			if err != nil {
 				return nil, err
@@ -457,10 +1152,15 @@ func For(v string, i, l, p float64, code List, s *Scope) (interface{}, error) {
 				break
 			}
 			i += p
-			s.Names[v] = i
+			names[v] = i
 		}
 	} else {
 		for i >= l {
+			if s.Interp.budget != nil {
+				if err := s.Interp.step(); err != nil {
+					return nil, err
+				}
+			}
 			value, err := Run(code, s)
 			if err != nil {
 				return nil, err
@@ -473,7 +1173,7 @@ func For(v string, i, l, p float64, code List, s *Scope) (interface{}, error) {
 				break
 			}
 			i += p
-			s.Names[v] = i
+			names[v] = i
 		}
 	}
 	return nil, nil
@@ -482,8 +1182,40 @@ func For(v string, i, l, p float64, code List, s *Scope) (interface{}, error) {
 // Foreach loop; the variable is always treated as local.
 func Foreach(v string, items, code List, s *Scope) (interface{}, error) {
 	v = strings.ToLower(v)
+	names := s.vars()
+	return foreach(items, func (i interface{}) {
+		names[v] = i
+	}, code, s)
+}
+
+// ForeachDict loops over the keys of a dictionary, in order. If v is empty,
+// k is set to each key in turn; otherwise v gets the matching value too.
+// Changes made to the dictionary from inside the loop don't affect it.
+func ForeachDict(k, v string, dict *Dict, code List, s *Scope) (
+	interface{}, error) {
+	k = strings.ToLower(k)
+	if v == "" {
+		return Foreach(k, dict.Keys(), code, s)
+	}
+	v = strings.ToLower(v)
+	names := s.vars()
+	return foreach(dict.Items(), func (i interface{}) {
+		pair := i.(List)
+		names[k] = pair[0]
+		names[v] = pair[1]
+	}, code, s)
+}
+
+// foreach runs code once for each item, after passing it to bind.
+func foreach(items List, bind func (interface{}), code List, s *Scope) (
+	interface{}, error) {
 	for _, i := range(items) {
-		s.Names[v] = i
+		if s.Interp.budget != nil {
+			if err := s.Interp.step(); err != nil {
+				return nil, err
+			}
+		}
+		bind(i)
 		value, err := Run(code, s)
 		if err != nil {
 			return nil, err
@@ -504,12 +1236,16 @@ func Fn(arglist []string, code List, scope *Scope) Closure {
 	for i, arg := range(arglist) {
 		arglist[i] = strings.ToLower(arg)
 	}
-	return Closure{arglist, code, scope}
+	// The scope can be reached from the closure now, Names and all.
+	scope.vars()
+	return Closure{Arglist: arglist, Code: code, Scope: scope}
 }
 
 // Function defines a named function in the current scope.
 func Function(name string, arglist []string, code List, scope *Scope) {
-	scope.Names[strings.ToLower(name)] = Fn(arglist, code, scope)
+	closure := Fn(arglist, code, scope)
+	closure.Name = strings.ToLower(name)
+	scope.vars()[closure.Name] = closure
 }
 
 // Map maps a user-defined function to the given argument list.
@@ -540,6 +1276,47 @@ func Filter(closure Closure, args List) (List, error) {
 	return results, nil
 }
 
+// MapDict maps a user-defined function to the values of a dictionary,
+// returning a new one with the same keys. A function taking two arguments
+// gets each key along with its value.
+func MapDict(closure Closure, dict *Dict) (*Dict, error) {
+	results := &Dict{}
+	for _, i := range(dict.Items()) {
+		pair := i.(List)
+		val, err := applyPair(closure, pair)
+		if err != nil {
+			return results, err
+		}
+		results.Put(pair[0], val)
+	}
+	return results, nil
+}
+
+// FilterDict returns a new dictionary with just the entries whose values
+// pass a user-defined function; as with MapDict, a function taking two
+// arguments gets each key along with its value.
+func FilterDict(closure Closure, dict *Dict) (*Dict, error) {
+	results := &Dict{}
+	for _, i := range(dict.Items()) {
+		pair := i.(List)
+		val, err := applyPair(closure, pair)
+		if err != nil {
+			return results, err
+		} else if ToBool(val) {
+			results.Put(pair[0], pair[1])
+		}
+	}
+	return results, nil
+}
+
+func applyPair(closure Closure, pair List) (interface{}, error) {
+	if len(closure.Arglist) == 2 {
+		return closure.Apply(pair...)
+	} else {
+		return closure.Apply(pair[1])
+	}
+}
+
 // Add adds two numbers, preserving the type if at all possible.
 func Add(a, b interface{}) interface{} {
 	switch t1 := a.(type) {
@@ -606,13 +1383,13 @@ func First(value interface{}) (interface{}, error) {
 		if len(seq) > 0 {
 			return seq[0], nil
 		} else {
-			return nil, Error{"First got an empty list."}
+			return nil, Error{Data: "First got an empty list."}
 		}
 	case string:
 		if len(seq) > 0 {
 			return seq[0:1], nil
 		} else {
-			return nil, Error{"First got an empty string."}
+			return nil, Error{Data: "First got an empty string."}
 		}
 	default:
 		return nil, FmtError("First expects a sequence, got:", value)
@@ -625,13 +1402,13 @@ func Last(value interface{}) (interface{}, error) {
 		if len(seq) > 0 {
 			return seq[len(seq) - 1], nil
 		} else {
-			return nil, Error{"Last got an empty list."}
+			return nil, Error{Data: "Last got an empty list."}
 		}
 	case string:
 		if len(seq) > 0 {
 			return seq[len(seq) - 1:len(seq)], nil
 		} else {
-			return nil, Error{"Last got an empty string."}
+			return nil, Error{Data: "Last got an empty string."}
 		}
 	default:
 		return nil, FmtError("Last expects a sequence, got:", value)
@@ -644,13 +1421,13 @@ func ButFirst(value interface{}) (interface{}, error) {
 		if len(seq) > 0 {
 			return seq[1:], nil
 		} else {
-			return nil, Error{"ButFirst got an empty list."}
+			return nil, Error{Data: "ButFirst got an empty list."}
 		}
 	case string:
 		if len(seq) > 0 {
 			return seq[1:], nil
 		} else {
-			return nil, Error{"ButFirst got an empty string."}
+			return nil, Error{Data: "ButFirst got an empty string."}
 		}
 	default:
 		return nil, FmtError(
@@ -664,13 +1441,13 @@ func ButLast(value interface{}) (interface{}, error) {
 		if len(seq) > 0 {
 			return seq[0:len(seq) - 1], nil
 		} else {
-			return nil, Error{"ButLast got an empty list."}
+			return nil, Error{Data: "ButLast got an empty list."}
 		}
 	case string:
 		if len(seq) > 0 {
 			return seq[0:len(seq) - 1], nil
 		} else {
-			return nil, Error{"ButLast got an empty string."}
+			return nil, Error{Data: "ButLast got an empty string."}
 		}
 	default:
 		return nil, FmtError(
@@ -699,20 +1476,20 @@ func Lput(item interface{}, seq List) List {
 	return ext
 }
 
-func Pick(value interface{}) (interface{}, error) {
+func Pick(value interface{}, rng *rand.Rand) (interface{}, error) {
 	switch seq := value.(type) {
 	case List:
 		if len(seq) > 0 {
-			return seq[rand.Intn(len(seq))], nil
+			return seq[rng.Intn(len(seq))], nil
 		} else {
-			return nil, Error{"Pick got an empty list."}
+			return nil, Error{Data: "Pick got an empty list."}
 		}
 	case string:
 		if len(seq) > 0 {
-			pos := rand.Intn(len(seq))
+			pos := rng.Intn(len(seq))
 			return seq[pos:pos + 1], nil
 		} else {
-			return nil, Error{"Pick got an empty string."}
+			return nil, Error{Data: "Pick got an empty string."}
 		}
 	default:
 		return nil, FmtError("Pick expects a sequence, got:", value)
@@ -724,10 +1501,17 @@ func SetItem(index int, seq List, item interface{}) {
 		index = len(seq) + index
 	}
 	seq[index] = item
+	// The list might be code that was already compiled.
+	forget(seq, index)
 }
 
 func Split(word string) List {
-	words := splitre.Split(strings.TrimSpace(word), -1)
+	return split(word, -1)
+}
+
+// split is Split, but stops at n words if n is positive, like SplitN.
+func split(word string, n int) List {
+	words := splitre.Split(strings.TrimSpace(word), n)
 	if len(words) == 1 && words[0] == "" {
 		return List{}
 	} else {
@@ -741,12 +1525,8 @@ func Copy(a interface{}) interface{} {
 		cp := List(make([]interface{}, len(data)))
 		copy(cp, data)
 		return cp
-	case Dict:
-		cp := make(map[interface{}]interface{}, len(data))
-		for k, v := range(data) {
-			cp[k] = v
-		}
-		return Dict(cp)
+	case *Dict:
+		return data.Copy()
 	default: return data
 	}
 }
@@ -759,6 +1539,15 @@ func Concat(seq1, seq2 List) List {
 	return cat
 }
 
+// iseqSize returns how many numbers Iseq would return, which may be
+// more than an int can count; 0 means one more than a uint64 can.
+func iseqSize(init, limit int) uint64 {
+	if init > limit {
+		init, limit = limit, init
+	}
+	return uint64(limit) - uint64(init) + 1
+}
+
 func Iseq(init, limit int) List {
 	if init <= limit {
 		seq := List(make([]interface{}, 0, limit - init + 1))
@@ -781,16 +1570,90 @@ func ToBool(input interface{}) bool {
 		case bool: return input
 		case int: return input != 0
 		case float64: return input != 0
-		default: panic(Error{fmt.Sprintf(
-			"Can't convert %#v to bool.", input)})
+		default: panic(cantConvert(input, "bool"))
 	}
 }
 
 func ToString(input interface{}) string {
 	switch input := input.(type) {
 		case string: return input
-		default: return fmt.Sprint(input)
+		default:
+			if err := printable(input, 0); err != nil {
+				panic(err)
+			}
+			return fmt.Sprint(input)
+	}
+}
+
+// printable checks that fmt can print value, which it can't if the value
+// contains itself, or is nested deeper than the Go stack allows; path has
+// the lists and dictionaries value is inside of.
+func printable(value interface{}, depth int, path ...interface{}) error {
+	if depth > maxNesting {
+		return Error{Data: "Data nested too deeply to print."}
+	}
+	var id interface{}
+	switch value := value.(type) {
+	case List:
+		if len(value) == 0 {
+			return nil
+		}
+		id = listID{&value[0], len(value)}
+	case *Dict:
+		id = value
+	case Closure:
+		return printable(value.Code, depth + 1, path...)
+	default:
+		return nil
+	}
+	for _, i := range(path) {
+		if i == id {
+			return Error{Data: "Can't print data that contains itself."}
+		}
+	}
+	path = append(path, id)
+	if list, ok := value.(List); ok {
+		for _, i := range(list) {
+			if err := printable(i, depth + 1, path...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, i := range(value.(*Dict).entries) {
+		if i.deleted {
+			continue
+		} else if err := printable(i.key, depth + 1, path...); err != nil {
+			return err
+		} else if err := printable(i.value, depth + 1, path...);
+			err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listID tells lists apart by their items, rather than what's in them.
+type listID struct {
+	first *interface{}
+	size int
+}
+
+// printableData returns data as is if it can be printed, or else why not,
+// for messages that have to be printed anyway.
+func printableData(data interface{}) interface{} {
+	if err := printable(data, 0); err != nil {
+		return err.(Error).Data
 	}
+	return data
+}
+
+// cantConvert reports a value of the wrong type for a conversion.
+func cantConvert(input interface{}, to string) Error {
+	if err := printable(input, 0); err != nil {
+		return err.(Error)
+	}
+	return Error{Data: fmt.Sprintf("Can't convert %#v to %s.", input, to)}
 }
 
 func ParseFloat(input interface{}) float64 {
@@ -817,11 +1680,9 @@ func ParseInt(input interface{}) int {
 			if err == nil {
 				return value
 			} else {
-				panic(Error{fmt.Sprintf(
-					"Can't convert %#v to int.", input)})
+				panic(cantConvert(input, "int"))
 			}
-		default: panic(Error{fmt.Sprintf(
-			"Can't convert %#v to int.", input)})
+		default: panic(cantConvert(input, "int"))
 	}
 }
 
@@ -854,35 +1715,22 @@ func Sublist(init, limit int, seq List) List {
 	if limit < 0 {
 		limit = len(seq) + limit
 	}
-	return seq[init:limit]
-}
-
-// NewDict returns a new dictionary off a list of alternating keys and values.
-func NewDict(init List) Dict {
-	dictionary := Dict{}
-	i := 0
-	for i < len(init) {
-		key := init[i]
-		i++
-		if i < len(init) {
-			dictionary[key] = init[i]
-		} else {
-			dictionary[key] = nil
-		}
-		i++
+	if limit > len(seq) {
+		// Go would allow it, up to the capacity of the list.
+		panic(Error{Data: fmt.Sprintf(
+			"Slice end %d past the end of a list of %d items.",
+			limit, len(seq))})
 	}
-	return dictionary
+	return seq[init:limit]
 }
 
-func DictKeys(dict Dict) List {
-	keys := List(make([]interface{}, 0, len(dict)))
-	for i := range(dict) {
-		keys = append(keys, i)
-	}
-	return keys
+// DictKeys returns the keys of a dictionary in the order they were added.
+func DictKeys(dict *Dict) List {
+	return dict.Keys()
 }
 
-var Procedures = map[string]Builtin {
+// Builtins is the default set of procedures each new interpreter starts with.
+var Builtins = map[string]Builtin {
 	"run": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		if code, ok := a[0].(List); ok {
 			return Run(code, s)
@@ -912,7 +1760,7 @@ var Procedures = map[string]Builtin {
 		return Catch(ToString(a[0]), code, s)
 	}},
 	"throw": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return nil, Error{a[0]}
+		return nil, Error{Data: a[0]}
 	}},
 
 	"break": {0, func (s *Scope, a ...interface{}) (interface{}, error) {
@@ -931,26 +1779,35 @@ var Procedures = map[string]Builtin {
 	
 	"print": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch value := a[0].(type) {
-			case List: PrintList(value)
-			default: fmt.Fprintln(Outs, value)
+			case List: PrintList(s.Interp.Outs, value)
+			default: fmt.Fprintln(s.Interp.Outs, ToString(value))
 		}
 		return nil, nil
 	}},
 	"type": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch value := a[0].(type) {
-			case List: TypeList(value)
-			default: fmt.Fprint(Outs, value)
+			case List: TypeList(s.Interp.Outs, value)
+			default: fmt.Fprint(s.Interp.Outs, ToString(value))
 		}
 		return nil, nil
 	}},
 	"show": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
-		fmt.Fprintln(Outs, a[0])
+		fmt.Fprintln(s.Interp.Outs, ToString(a[0]))
+		return nil, nil
+	}},
+
+	"printf": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		text, err := format(
+			ToString(a[0]), a[1].(List), s.Interp.MaxString)
+		if err != nil { return nil, err }
+		fmt.Fprint(s.Interp.Outs, text)
 		return nil, nil
 	}},
 
 	"readword": {0,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		word, err := Readword()
+		word, err := s.Interp.Input().readLine(s.Interp.MaxString)
 		if err == bufio.ErrFinalToken {
 			return nil, nil
 		} else {
@@ -959,15 +1816,142 @@ var Procedures = map[string]Builtin {
 	}},
 	"readlist": {0,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		word, err := Readword()
+		word, err := s.Interp.Input().readLine(s.Interp.MaxString)
+		if err == bufio.ErrFinalToken {
+			return nil, nil
+		} else if err == nil {
+			return s.Interp.split(word)
+		} else {
+			return List{}, err
+		}
+	}},
+	"readchar": {0,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		char, err := s.Interp.Input().ReadChar()
+		if err == bufio.ErrFinalToken {
+			return nil, nil
+		} else {
+			return char, err
+		}
+	}},
+	"read-all": {0,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return readAll(s, s.Interp.Input())
+	}},
+	"is-eof": {0,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return s.Interp.Input().AtEOF()
+	}},
+	"print-to": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		out, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		switch value := a[1].(type) {
+			case List: PrintList(out, value)
+			default: fmt.Fprintln(out, ToString(value))
+		}
+		return nil, nil
+	}},
+	"type-to": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		out, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		switch value := a[1].(type) {
+			case List: TypeList(out, value)
+			default: fmt.Fprint(out, ToString(value))
+		}
+		return nil, nil
+	}},
+	"show-to": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		out, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		fmt.Fprintln(out, ToString(a[1]))
+		return nil, nil
+	}},
+	"readword-from": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		in, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		word, err := in.readLine(s.Interp.MaxString)
+		if err == bufio.ErrFinalToken {
+			return nil, nil
+		} else {
+			return word, err
+		}
+	}},
+	"readlist-from": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		in, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		word, err := in.readLine(s.Interp.MaxString)
 		if err == bufio.ErrFinalToken {
 			return nil, nil
 		} else if err == nil {
-			return Split(word), nil
+			return s.Interp.split(word)
 		} else {
 			return List{}, err
 		}
 	}},
+
+	"readchar-from": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		in, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		char, err := in.ReadChar()
+		if err == bufio.ErrFinalToken {
+			return nil, nil
+		} else {
+			return char, err
+		}
+	}},
+	"read-all-from": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		in, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		return readAll(s, in)
+	}},
+	"is-eof-from": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		in, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		return in.AtEOF()
+	}},
+
+	"open": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
+		return Open(ToString(a[0]), ToString(a[1]))
+	}},
+	"close": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
+		stream, err := ToStream(a[0])
+		if err != nil { return nil, err }
+		return nil, stream.Close()
+	}},
+	"read-file": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		text, err := readFile(ToString(a[0]), s.Interp.MaxString)
+		if err != nil {
+			return nil, err
+		}
+		return text, nil
+	}},
+	"read-lines": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		lines, err := readLines(ToString(a[0]), s.Interp.MaxString)
+		if err != nil {
+			return nil, err
+		} else if err := s.Interp.fitList(len(lines)); err != nil {
+			return nil, err
+		}
+		return lines, nil
+	}},
+	"write-file": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return nil, WriteFile(ToString(a[0]), ToString(a[1]), false)
+	}},
+	"append-file": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return nil, WriteFile(ToString(a[0]), ToString(a[1]), true)
+	}},
 	
 	"make": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
 		varname := ToString(a[0])
@@ -979,16 +1963,16 @@ var Procedures = map[string]Builtin {
 		case List:
 			for _, i := range(name) {
 				tmp := strings.ToLower(ToString(i))
-				s.Names[tmp] = nil
+				s.vars()[tmp] = nil
 			}
-		default: s.Names[strings.ToLower(ToString(name))] = nil
+		default: s.vars()[strings.ToLower(ToString(name))] = nil
 		}
 		return nil, nil
 	}},
 	"localmake": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		varname := ToString(a[0])
-		s.Names[strings.ToLower(varname)] = a[1]
+		varname := strings.ToLower(ToString(a[0]))
+		s.vars()[varname] = a[1]
 		return nil, nil
 	}},
 	"thing": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
@@ -1015,7 +1999,7 @@ var Procedures = map[string]Builtin {
 	}},
 	"iftrue": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		if s.test == nil {
-			return nil, Error{"Iftrue without test."}
+			return nil, Error{Data: "Iftrue without test."}
 		} else if *s.test {
 			return Run(a[0].(List), s)
 		} else {
@@ -1024,7 +2008,7 @@ var Procedures = map[string]Builtin {
 	}},
 	"iffalse": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		if s.test == nil {
-			return nil, Error{"Iffalse without test."}
+			return nil, Error{Data: "Iffalse without test."}
 		} else if !*s.test {
 			return Run(a[0].(List), s)
 		} else {
@@ -1042,9 +2026,23 @@ var Procedures = map[string]Builtin {
 	}},
 	"foreach": {3,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
+		code := a[2].(List)
+		if dict, ok := a[1].(*Dict); ok {
+			if names, ok := a[0].(List); !ok {
+				return ForeachDict(ToString(a[0]), "", dict, code, s)
+			} else if len(names) == 1 {
+				return ForeachDict(
+					ToString(names[0]), "", dict, code, s)
+			} else if len(names) == 2 {
+				return ForeachDict(ToString(names[0]),
+					ToString(names[1]), dict, code, s)
+			} else {
+				return nil, FmtError(
+					"Foreach takes one or two names, got:", names)
+			}
+		}
 		varname := ToString(a[0])
 		items := a[1].(List)
-		code := a[2].(List)
 		return Foreach(varname, items, code, s)
 	}},
 	
@@ -1070,12 +2068,18 @@ var Procedures = map[string]Builtin {
 	"map": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
 		closure := a[0].(Closure)
+		if dict, ok := a[1].(*Dict); ok {
+			return MapDict(closure, dict)
+		}
 		args := a[1].(List)
 		return Map(closure, args)
 	}},
 	"filter": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
 		closure := a[0].(Closure)
+		if dict, ok := a[1].(*Dict); ok {
+			return FilterDict(closure, dict)
+		}
 		args := a[1].(List)
 		return Filter(closure, args)
 	}},
@@ -1218,7 +2222,7 @@ var Procedures = map[string]Builtin {
 	func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch seq := a[0].(type) {
 			case List: return len(seq), nil
-			case Dict: return len(seq), nil
+			case *Dict: return seq.Len(), nil
 			case string: return len(seq), nil
 			default: return nil, FmtError(
 				"Count expects a list or string, got:", a[0])
@@ -1229,14 +2233,30 @@ var Procedures = map[string]Builtin {
 		return Sorted(a[0].(List)), nil
 	}},
 	
+	"sort-by": {3,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return SortBy(a[0], a[1].(List), ToBool(a[2]), s)
+	}},
+	"sort-with": {3,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return SortWith(a[0], a[1].(List), ToBool(a[2]), s)
+	}},
 	"list": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
 		return List{a[0], a[1]}, nil
 	}},
 	"fput": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Fput(a[0], a[1].(List)), nil
+		seq := a[1].(List)
+		if err := s.Interp.fitList(len(seq) + 1); err != nil {
+			return nil, err
+		}
+		return Fput(a[0], seq), nil
 	}},
 	"lput": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Lput(a[0], a[1].(List)), nil
+		seq := a[1].(List)
+		if err := s.Interp.fitList(len(seq) + 1); err != nil {
+			return nil, err
+		}
+		return Lput(a[0], seq), nil
 	}},
 	"item": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
 		index := ParseInt(a[0])
@@ -1256,12 +2276,24 @@ var Procedures = map[string]Builtin {
 		}
 	}},
 	"iseq": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Iseq(ParseInt(a[0]), ParseInt(a[1])), nil
+		init, limit := ParseInt(a[0]), ParseInt(a[1])
+		size := iseqSize(init, limit)
+		if size == 0 || size > math.MaxInt {
+			size = math.MaxInt
+		}
+		if err := s.Interp.fitList(int(size)); err != nil {
+			return nil, err
+		}
+		return Iseq(init, limit), nil
 	}},
 
 	"array": {1,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		return List(make([]interface{}, ParseInt(a[0]))), nil
+		size := ParseInt(a[0])
+		if err := s.Interp.fitList(size); err != nil {
+			return nil, err
+		}
+		return List(make([]interface{}, size)), nil
 	}},
 	"copy": {1,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
@@ -1269,7 +2301,12 @@ var Procedures = map[string]Builtin {
 	}},
 	"concat": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Concat(a[0].(List), a[1].(List)), nil
+		seq1, seq2 := a[0].(List), a[1].(List)
+		err := s.Interp.fitList(len(seq1) + len(seq2))
+		if err != nil {
+			return nil, err
+		}
+		return Concat(seq1, seq2), nil
 	}},
 	"slice": {3,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
@@ -1325,30 +2362,87 @@ var Procedures = map[string]Builtin {
 	}},
 	
 	"split": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Split(ToString(a[0])), nil
+		return s.Interp.split(ToString(a[0]))
 	}},
 	"join": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch seq := a[0].(type) {
-		case List: return strings.Join(StringSlice(seq), " "), nil
+		case List: return s.Interp.join(StringSlice(seq), " ")
 		default: return nil, FmtError(
 			"Join expects a list, got:", a[0])
 		}
 	}},
 	"split-by": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		return strings.Split(ToString(a[1]), ToString(a[0])), nil
+		words := strings.SplitN(
+			ToString(a[1]), ToString(a[0]), s.Interp.listCap())
+		if err := s.Interp.fitList(len(words)); err != nil {
+			return nil, err
+		}
+		return StringList(words), nil
 	}},
 	"join-by": {2,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch seq := a[1].(type) {
-		case List: return strings.Join(
-			StringSlice(seq), ToString(a[0])), nil
+		case List: return s.Interp.join(
+			StringSlice(seq), ToString(a[0]))
 		default: return nil, FmtError(
 			"Join-by expects a list, got:", a[1])
 		}
 	}},
+	"match": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
+		re, err := s.Interp.pattern(ToString(a[0]))
+		if err != nil { return nil, err }
+		return re.MatchString(ToString(a[1])), nil
+	}},
+	"match-all": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		re, err := s.Interp.pattern(ToString(a[0]))
+		if err != nil { return nil, err }
+		matches := matchAll(re, ToString(a[1]), s.Interp.listCap())
+		if err := s.Interp.fitList(len(matches)); err != nil {
+			return nil, err
+		}
+		return matches, nil
+	}},
+	"re-replace": {3,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		re, err := s.Interp.pattern(ToString(a[0]))
+		if err != nil { return nil, err }
+		return replaceAll(re, ToString(a[2]), ToString(a[1]),
+			s.Interp.MaxString)
+	}},
+	"re-split": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		re, err := s.Interp.pattern(ToString(a[0]))
+		if err != nil { return nil, err }
+		words := re.Split(ToString(a[1]), s.Interp.listCap())
+		if err := s.Interp.fitList(len(words)); err != nil {
+			return nil, err
+		}
+		return StringList(words), nil
+	}},
+	"format": {2,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		text, err := format(
+			ToString(a[0]), a[1].(List), s.Interp.MaxString)
+		if err != nil {
+			return nil, err
+		} else if err := s.Interp.fitString(len(text)); err != nil {
+			return nil, err
+		}
+		return text, nil
+	}},
+	"to-json": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return s.Interp.toJSON(a[0])
+	}},
+	"parse-json": {1,
+	func (s *Scope, a ...interface{}) (interface{}, error) {
+		return s.Interp.parseJSON(ToString(a[0]))
+	}},
 	"word": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return ToString(a[0]) + ToString(a[1]), nil
+		words := []string{ToString(a[0]), ToString(a[1])}
+		return s.Interp.join(words, "")
 	}},
 
 	"starts-with": {2,
@@ -1364,6 +2458,9 @@ var Procedures = map[string]Builtin {
 	
 	"to-string": {1,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
+		if err := s.Interp.fitPrinted(a[0]); err != nil {
+			return nil, err
+		}
 		return ToString(a[0]), nil
 	}},
 	"parse-int": {1,
@@ -1402,7 +2499,7 @@ var Procedures = map[string]Builtin {
 	}},
 	"is-dict": {1,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		_, ok := a[0].(Dict)
+		_, ok := a[0].(*Dict)
 		return ok, nil
 	}},
 	"is-fn": {1,
@@ -1435,22 +2532,34 @@ var Procedures = map[string]Builtin {
 	
 	"dict": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
 		switch seq := a[0].(type) {
-			case List: return NewDict(seq), nil
+			case List:
+				err := s.Interp.fitDict((len(seq) + 1) / 2)
+				if err != nil {
+					return nil, err
+				}
+				return NewDict(seq), nil
 			default: return nil, FmtError(
 				"Dict expects a list, got:", a[0])
 		}
 	}},
 	"get": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		if dict, ok := a[0].(Dict); ok {
-			return dict[a[1]], nil
+		if dict, ok := a[0].(*Dict); ok {
+			value, _ := dict.Get(a[1])
+			return value, nil
 		} else {
 			return  nil, FmtError(
 				"Get expects a dictionary, got:", a[0])
 		}
 	}},
 	"put": {3, func (s *Scope, a ...interface{}) (interface{}, error) {
-		if dict, ok := a[0].(Dict); ok {
-			dict[a[1]] = a[2]
+		if dict, ok := a[0].(*Dict); ok {
+			if _, ok := dict.Get(a[1]); !ok {
+				err := s.Interp.fitDict(dict.Len() + 1)
+				if err != nil {
+					return nil, err
+				}
+			}
+			dict.Put(a[1], a[2])
 			return nil, nil
 		} else {
 			return  nil, FmtError(
@@ -1458,8 +2567,8 @@ var Procedures = map[string]Builtin {
 		}
 	}},
 	"del": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
-		if dict, ok := a[0].(Dict); ok {
-			delete(dict, ToString(a[1]))
+		if dict, ok := a[0].(*Dict); ok {
+			dict.Del(a[1])
 			return nil, nil
 		} else {
 			return  nil, FmtError(
@@ -1467,24 +2576,30 @@ var Procedures = map[string]Builtin {
 		}
 	}},
 	"keys": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return DictKeys(a[0].(Dict)), nil
+		return DictKeys(a[0].(*Dict)), nil
+	}},
+	"values": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
+		return a[0].(*Dict).Values(), nil
+	}},
+	"items": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
+		return a[0].(*Dict).Items(), nil
 	}},
 
 	"rnd": {0, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return rand.Float64(), nil
+		return s.Interp.Rand.Float64(), nil
 	}},
 	"random": {2, func (s *Scope, a ...interface{}) (interface{}, error) {
 		low := ParseInt(a[0])
 		high := ParseInt(a[1])
-		return rand.Intn(high - low + 1) + low, nil
+		return s.Interp.Rand.Intn(high - low + 1) + low, nil
 	}},
 	"rerandom": {1,
 	func (s *Scope, a ...interface{}) (interface{}, error) {
-		rand.Seed(int64(ParseFloat(a[0])))
+		s.Interp.Rand.Seed(int64(ParseFloat(a[0])))
 		return nil, nil
 	}},
 	"pick": {1, func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Pick(a[0])
+		return Pick(a[0], s.Interp.Rand)
 	}},
 
 	"timer": {0, func (s *Scope, a ...interface{}) (interface{}, error) {
@@ -1493,96 +2608,140 @@ var Procedures = map[string]Builtin {
 	}},
 }
 
+// Groups sorts the built-in procedures by what they give access to,
+// so that untrusted code can be kept away from some of them. All but
+// filesystem and load are available by default.
+var Groups = map[string][]string {
+	"core": {
+		"run", "results", "ignore", "catch", "throw",
+		"break", "continue", "return",
+		"make", "local", "localmake", "thing",
+		"if", "test", "iftrue", "iffalse", "for", "foreach",
+		"while", "ifelse", "parse", "procedures",
+		"function", "fn", "apply", "map", "filter", "arity",
+		"lt", "lte", "eq", "neq", "gt", "gte", "and", "or", "not",
+		"first", "last", "butfirst", "butlast", "count", "sorted",
+		"sort-by", "sort-with",
+		"list", "fput", "lput", "item", "iseq", "array", "copy",
+		"concat", "slice", "setitem",
+		"dict", "get", "put", "del", "keys",
+		"values", "items",
+		"is-string", "is-bool", "is-int", "is-float",
+		"is-list", "is-dict", "is-fn", "is-proc"},
+	"math": {
+		"add", "sub", "mul", "div", "mod", "pow", "abs", "minus",
+		"int", "pi", "sqrt", "sin", "cos", "rad", "deg", "hypot",
+		"min", "max", "parse-int", "parse-float",
+		"rnd", "random", "rerandom", "pick", "timer"},
+	"strings": {
+		"lowercase", "uppercase", "trim", "ltrim", "rtrim",
+		"empty", "space", "tab", "cr", "lf",
+		"split", "join", "split-by", "join-by", "word",
+		"starts-with", "ends-with", "to-string",
+		"format", "to-json", "parse-json",
+		"match", "match-all", "re-replace", "re-split",
+		"is-space", "is-alpha", "is-alnum", "is-digit"},
+	"io": {
+		"print", "type", "show", "printf", "readword", "readlist",
+		"readchar", "read-all", "is-eof",
+		"print-to", "type-to", "show-to",
+		"readword-from", "readlist-from",
+		"readchar-from", "read-all-from", "is-eof-from"},
+	"filesystem": {
+		"open", "close", "read-file", "read-lines",
+		"write-file", "append-file"},
+	"load": {"load"},
+}
+
+// NewSandbox returns an interpreter like NewInterpreter does, but with
+// only the procedures in the given groups; unknown groups add nothing.
+func NewSandbox(groups ...string) *Interpreter {
+	interp := NewInterpreter()
+	interp.Procedures = make(map[string]Builtin)
+	interp.Allow(groups...)
+	return interp
+}
+
+// Allow adds the procedures in the given groups to those the interpreter
+// has, such as filesystem and load, which it lacks by default.
+func (self *Interpreter) Allow(groups ...string) {
+	for _, group := range(groups) {
+		for _, name := range(Groups[group]) {
+			self.Procedures[name] = Builtins[name]
+		}
+	}
+}
+
 func init() {
 	tmp := func (s *Scope, a ...interface{}) (interface{}, error) {
-		return Load(ToString(a[0]), Procedures, s)
+		return Load(ToString(a[0]), s)
 	}
-	Procedures["load"] = Builtin{1, tmp}
+	Builtins["load"] = Builtin{1, tmp}
 
 	tmp = func (s *Scope, a ...interface{}) (interface{}, error) {
 		if words, ok := a[0].(List); ok {
-			return Parse(StringSlice(words), Procedures)
+			return s.Interp.parseWords(words)
 		} else {
 			return nil, FmtError(
 				"Parse expects a list, found:", a[0])
 		}
 	}
-	Procedures["parse"] = Builtin{1, tmp}
+	Builtins["parse"] = Builtin{1, tmp}
 
 	tmp = func (s *Scope, a ...interface{}) (interface{}, error) {
 		// The condition must be a literal list.
 		cond := a[0].(List)
 		code := a[1].(List)
-		pcond, err := Parse(StringSlice(cond), Procedures)
+		pcond, err := s.Interp.parsed(cond)
 		if err != nil {
 			return nil, err
 		} else {
 			return While(pcond, code, s)
 		}
 	}
-	Procedures["while"] = Builtin{2, tmp}
+	Builtins["while"] = Builtin{2, tmp}
 
 	tmp = func (s *Scope, a ...interface{}) (interface{}, error) {
 		cond := ToBool(a[0])
 		iftrue := a[1].(List)
 		iffalse := a[2].(List)
+		branch := iffalse
 		if cond {
-			code, err := Parse(StringSlice(iftrue), Procedures)
-			if err != nil {
-				return nil, err
-			} else {
-				res, err := Results(code, s)
-				return res[0], err
-			}
+			branch = iftrue
+		}
+		code, err := s.Interp.parsed(branch)
+		if err != nil {
+			return nil, err
+		}
+		res, err := Results(code, s)
+		if err != nil {
+			return nil, err
 		} else {
-			code, err := Parse(StringSlice(iffalse), Procedures)
-			if err != nil {
-				return nil, err
-			} else {
-				res, err := Results(code, s)
-				return res[0], err
-			}
+			return res[0], nil
 		}
 	}
-	Procedures["ifelse"] = Builtin{3, tmp}
+	Builtins["ifelse"] = Builtin{3, tmp}
 
 	tmp = func (s *Scope, a ...interface{}) (interface{}, error) {
-		names := make([]interface{}, 0, len(Procedures))
-		for i := range(Procedures) {
+		procs := s.Interp.Procedures
+		names := make([]interface{}, 0, len(procs))
+		for i := range(procs) {
 			names = append(names, i)
 		}
 		return List(names), nil
 	}
-	Procedures["procedures"] = Builtin{0, tmp}
-}
+	Builtins["procedures"] = Builtin{0, tmp}
 
-func main() {
-	if len(os.Args) > 1 {
-		rand.Seed(time.Now().UnixNano())
-		defer func () {
-			if err := recover(); err != nil {
-				fmt.Println(err)
-			}
-		}()
-		toplevel := Scope{Names: map[string]interface{}{}}
-		code, err := Parse(os.Args[1:], Procedures)
-		if err == nil {
-			results, err2 := Results(code, &toplevel)
-			if err2 == nil {
-				for _, i := range(results) {
-					if i != nil {
-						fmt.Println(i)
-					}
-				}
-			} else {
-				fmt.Fprintln(Errs, err2)
-			}
-		} else {
-			fmt.Fprintln(Errs, err)
-		} 
-	} else {
-		fmt.Println("Lunar Logo beta, 2017-02-09")
-		fmt.Println("Usage:\n\tlunar [logo code...]")
-		fmt.Println("\tlunar load <filename>")
+	grouped := make(map[string]bool, len(Builtins))
+	for _, names := range(Groups) {
+		for _, name := range(names) {
+			grouped[name] = true
+		}
+	}
+	for name, proc := range(Builtins) {
+		if !grouped[name] {
+			panic("Procedure not in any group: " + name)
+		}
+		ownCode[reflect.ValueOf(proc.Code).Pointer()] = true
 	}
 }
@@ -0,0 +1,87 @@
+package lunar
+
+import (
+	"testing"
+)
+
+// try runs a script, returning the value of each statement.
+func try(interp *Interpreter, src string) (List, error) {
+	code, err := interp.ParseTokens(Tokenize(src, Pos{Line: 1, Column: 1}))
+	if err != nil {
+		return nil, err
+	}
+	return Results(code, interp.Toplevel)
+}
+
+// results is like try, but fails the test on errors.
+func results(t *testing.T, interp *Interpreter, src string) List {
+	t.Helper()
+	values, err := try(interp, src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return values
+}
+
+func TestParseNested(t *testing.T) {
+	tests := []struct {
+		src string
+		want string
+	}{
+		{`parse [1 [2 3]]`, `[[1 [2 3]]]`},
+		{`count item 1 parse [1 [2 3]]`, `[2]`},
+		{`is-int item 0 parse [1 [2 3]]`, `[true]`},
+		{`parse [a [b [c d]] []]`, `[[a [b [c d]] []]]`},
+		{`count item 1 parse [[a] [b c d]]`, `[3]`},
+	}
+	for _, test := range(tests) {
+		got := ToString(results(t, NewInterpreter(), test.src))
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestParseLiterals(t *testing.T) {
+	tests := []struct {
+		src string
+		want string
+	}{
+		{`"a b"`, `[a b]`},
+		{`count parse ["a b" c]`, `[2]`},
+		{`is-string item 0 parse ["12"]`, `[true]`},
+		{`is-int item 0 parse [12]`, `[true]`},
+		{`item 1 parse [1 ["x y" z]]`, `[[x y z]]`},
+		{`count item 1 parse [1 ["x y" z]]`, `[2]`},
+		{`first "\tb"`, "[\t]"},
+		{`ifelse true ["print"] [2]`, `[print]`},
+		{`ifelse true ["end" "do"] [2]`, `[end]`},
+	}
+	for _, test := range(tests) {
+		got := ToString(results(t, NewInterpreter(), test.src))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestParseConditions(t *testing.T) {
+	tests := []struct {
+		src string
+		want string
+	}{
+		{`make i 0 while [lt :i count [a b c]] do make i add :i 1 end :i`,
+			`[<nil> <nil> 3]`},
+		{`make i 0 while [lt :i 3] do make i add :i 1 end :i`,
+			`[<nil> <nil> 3]`},
+		{`ifelse true [count [a b c]] [0]`, `[3]`},
+		{`ifelse false [0] [item 1 [a [b c]]]`, `[[b c]]`},
+		{`ifelse eq 1 1 [word "a b" "c"] [0]`, `[a bc]`},
+	}
+	for _, test := range(tests) {
+		got := ToString(results(t, NewInterpreter(), test.src))
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package lunar
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Functions that end by returning a call must be able to recurse far
+// deeper than the call depth limit, which they only can without frames.
+func TestTailRecursion(t *testing.T) {
+	var out bytes.Buffer
+	interp := NewInterpreter()
+	interp.Outs = &out
+	if _, err := Load("examples/recursion.lulz", interp.Toplevel); err != nil {
+		t.Fatal(err)
+	}
+	if want := "45000150000\ntrue\ntrue\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+// Printing data that contains itself, or is nested too deeply, has to
+// give an error scripts can catch, not crash the program.
+func TestPrintNested(t *testing.T) {
+	for _, src := range([]string{
+		`make l [1 2] setitem 0 :l :l`,
+		`make l [1 2] setitem 0 :l list :l :l`,
+		`make l dict [] put :l "self" :l`,
+		`make l [] for "i" 1 2000 1 do make l list :l :i end`,
+	}) {
+		interp := NewInterpreter()
+		var out bytes.Buffer
+		interp.Outs = &out
+		results(t, interp, src)
+		for _, use := range([]string{
+			`show :l`, `print :l`, `type :l`, `to-string :l`,
+			`word "a" :l`, `if :l []`, `throw :l`,
+		}) {
+			got := results(t, interp, `catch e do ` + use + ` end :e`)
+			if msg := ToString(got[1]); !strings.Contains(msg, "print") {
+				t.Errorf("%s then %s: got %s", src, use, msg)
+			}
+		}
+		if out.Len() > 0 {
+			t.Errorf("%s: printed %q", src, out.String())
+		}
+	}
+}
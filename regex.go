@@ -0,0 +1,62 @@
+package lunar
+
+import (
+	"regexp"
+)
+
+// maxPatterns limits how many compiled regular expressions an interpreter
+// keeps around for reuse.
+const maxPatterns = 256
+
+// pattern compiles a regular expression, or finds it already compiled.
+func (self *Interpreter) pattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := self.patterns[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, Error{Data: "Bad regular expression: " + err.Error()}
+	}
+	if self.patterns == nil || len(self.patterns) >= maxPatterns {
+		self.patterns = make(map[string]*regexp.Regexp)
+	}
+	self.patterns[expr] = re
+	return re, nil
+}
+
+// MatchAll finds every match of re in text, each as a list of the whole
+// match followed by the capture groups.
+func MatchAll(re *regexp.Regexp, text string) List {
+	return matchAll(re, text, -1)
+}
+
+// matchAll is MatchAll, but stops at n matches if n is not negative.
+func matchAll(re *regexp.Regexp, text string, n int) List {
+	found := re.FindAllStringSubmatch(text, n)
+	matches := make(List, len(found))
+	for i, groups := range(found) {
+		matches[i] = StringList(groups)
+	}
+	return matches
+}
+
+// replaceAll is re.ReplaceAllString, except it gives up as soon as the
+// result is more than limit bytes long, if limit is positive.
+func replaceAll(
+	re *regexp.Regexp, text, repl string, limit int) (string, error) {
+	if limit <= 0 {
+		return re.ReplaceAllString(text, repl), nil
+	}
+	var out []byte
+	last := 0
+	for _, match := range(re.FindAllStringSubmatchIndex(text, -1)) {
+		out = append(out, text[last:match[0]]...)
+		out = re.ExpandString(out, repl, text, match)
+		last = match[1]
+		if err := fitString(len(out) + len(text) - last, limit);
+			err != nil {
+			return "", err
+		}
+	}
+	return string(append(out, text[last:]...)), nil
+}
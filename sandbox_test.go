@@ -0,0 +1,114 @@
+package lunar
+
+import (
+	"testing"
+)
+
+func TestGroupsKnown(t *testing.T) {
+	seen := map[string]string{}
+	for group, names := range(Groups) {
+		for _, name := range(names) {
+			if _, ok := Builtins[name]; !ok {
+				t.Errorf("%s in group %s is no procedure", name, group)
+			}
+			if other, ok := seen[name]; ok {
+				t.Errorf("%s is in both %s and %s", name, group, other)
+			}
+			seen[name] = group
+		}
+	}
+	for name := range(Builtins) {
+		if _, ok := seen[name]; !ok {
+			t.Errorf("%s is in no group", name)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	interp := NewInterpreter()
+	for group, names := range(Groups) {
+		off := group == "filesystem" || group == "load"
+		for _, name := range(names) {
+			if _, ok := interp.Procedures[name]; ok == off {
+				t.Errorf("%s from %s: have %v, want %v",
+					name, group, ok, !off)
+			}
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	interp := NewInterpreter()
+	interp.Allow("filesystem", "load")
+	if len(interp.Procedures) != len(Builtins) {
+		t.Errorf("got %d procedures, want %d",
+			len(interp.Procedures), len(Builtins))
+	}
+	interp = NewSandbox("math")
+	interp.Allow("strings", "nonsense")
+	for name := range(interp.Procedures) {
+		if !inGroup(name, "math") && !inGroup(name, "strings") {
+			t.Errorf("%s shouldn't be allowed", name)
+		}
+	}
+	if len(interp.Procedures) !=
+		len(Groups["math"]) + len(Groups["strings"]) {
+		t.Errorf("got %d procedures", len(interp.Procedures))
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if n := len(NewSandbox().Procedures); n != 0 {
+		t.Errorf("empty sandbox has %d procedures", n)
+	}
+	if n := len(NewSandbox("nonsense").Procedures); n != 0 {
+		t.Errorf("unknown group gave %d procedures", n)
+	}
+	interp := NewSandbox("core", "math")
+	got := results(t, interp, `make x add 1 2 :x`)
+	if want := "[<nil> 3]"; ToString(got) != want {
+		t.Errorf("got %s, want %s", ToString(got), want)
+	}
+	// Without the procedure, the words are only words.
+	got = results(t, interp, `print "hello"`)
+	if want := "[print hello]"; ToString(got) != want {
+		t.Errorf("got %s, want %s", ToString(got), want)
+	}
+}
+
+// Scripts in a sandbox must not get at files, not even by name.
+func TestSandboxFiles(t *testing.T) {
+	for _, interp := range([]*Interpreter{
+		NewInterpreter(), NewSandbox("core", "io", "strings"),
+	}) {
+		code, err := interp.ParseTokens(Tokenize(`load "x"`, Pos{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range(code) {
+			if _, ok := item.(string); !ok {
+				t.Errorf("load \"x\" parsed to %#v", code)
+			}
+		}
+		tests := map[string]string{
+			`load "x"`: "[load x]",
+			`read-file "go.mod"`: "[read-file go.mod]",
+			`open "go.mod" "r"`: "[open go.mod r]",
+		}
+		for src, want := range(tests) {
+			got := results(t, interp, src)
+			if ToString(got) != want {
+				t.Errorf("%s: got %s, want %s", src, ToString(got), want)
+			}
+		}
+	}
+}
+
+func inGroup(name, group string) bool {
+	for _, other := range(Groups[group]) {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package lunar
+
+import (
+	"sort"
+)
+
+// callFn calls a closure or procedure passed to another procedure.
+func callFn(
+	fn interface{}, s *Scope, args ...interface{}) (interface{}, error) {
+	switch fn := fn.(type) {
+	case Closure:
+		return fn.Apply(args...)
+	case Builtin:
+		if fn.Arity != len(args) {
+			return nil, FmtError(
+				"Procedure called with wrong number of arguments:",
+				len(args))
+		}
+		return fn.Call(s, args...)
+	default:
+		return nil, FmtError("Expected fn or procedure, got:", fn)
+	}
+}
+
+// SortBy returns a copy of seq sorted by the keys the given function
+// returns for each item, from largest to smallest if reverse is set.
+// Items with equal keys stay in the same order.
+func SortBy(
+	key interface{}, seq List, reverse bool, s *Scope) (List, error) {
+	keys := make(List, len(seq))
+	for i, item := range(seq) {
+		k, err := callFn(key, s, item)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+	order := make([]int, len(seq))
+	for i := range(order) {
+		order[i] = i
+	}
+	sort.SliceStable(order, func (i, j int) bool {
+		if reverse {
+			return keys.Less(order[j], order[i])
+		} else {
+			return keys.Less(order[i], order[j])
+		}
+	})
+	sorted := make(List, len(seq))
+	for i, j := range(order) {
+		sorted[i] = seq[j]
+	}
+	return sorted, nil
+}
+
+// SortWith returns a copy of seq sorted by a function that tells if its
+// first argument goes before the second, like lt does; it's the other way
+// around if reverse is set. Items that compare equal stay in the same order.
+func SortWith(
+	less interface{}, seq List, reverse bool, s *Scope) (List, error) {
+	sorted := make(List, len(seq))
+	copy(sorted, seq)
+	var err error
+	sort.SliceStable(sorted, func (i, j int) bool {
+		if err != nil {
+			return false
+		}
+		a, b := sorted[i], sorted[j]
+		if reverse {
+			a, b = b, a
+		}
+		var result interface{}
+		result, err = callFn(less, s, a, b)
+		return err == nil && ToBool(result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sorted, nil
+}
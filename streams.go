@@ -0,0 +1,235 @@
+package lunar
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// Stream is a file opened by a script, for either reading or writing,
+// or the input of an interpreter. Reading is buffered, and the buffer
+// lasts as long as the stream, so nothing gets lost between reads.
+type Stream struct {
+	Name string
+	file *os.File
+	in *bufio.Reader
+}
+
+// NewStream makes a stream for reading from any source.
+func NewStream(name string, in io.Reader) *Stream {
+	return &Stream{Name: name, in: bufio.NewReader(in)}
+}
+
+// Input returns a stream reading from Ins, keeping it across calls
+// unless Ins changes.
+func (self *Interpreter) Input() *Stream {
+	if self.input == nil || self.inputOf != self.Ins {
+		self.input = NewStream("<input>", self.Ins)
+		self.inputOf = self.Ins
+	}
+	return self.input
+}
+
+// Open opens a file for reading ("r"), writing ("w") or appending ("a").
+func Open(fn, mode string) (*Stream, error) {
+	var flags int
+	switch mode {
+		case "r": flags = os.O_RDONLY
+		case "w": flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		case "a": flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		default: return nil, FmtError("Unknown mode for open:", mode)
+	}
+	file, err := os.OpenFile(fn, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	stream := &Stream{Name: fn, file: file}
+	if mode == "r" {
+		stream.in = bufio.NewReader(file)
+	}
+	return stream, nil
+}
+
+func (self *Stream) Read(p []byte) (int, error) {
+	if self.in == nil {
+		return 0, FmtError("Stream not open for reading:", self.Name)
+	}
+	return self.in.Read(p)
+}
+
+func (self *Stream) Write(p []byte) (int, error) {
+	if self.in != nil || self.file == nil {
+		return 0, FmtError("Stream not open for writing:", self.Name)
+	}
+	return self.file.Write(p)
+}
+
+func (self *Stream) Close() error {
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file, self.in = nil, nil
+	return err
+}
+
+func (self *Stream) String() string {
+	return "<stream " + self.Name + ">"
+}
+
+// ToStream checks that a procedure argument is a stream.
+func ToStream(value interface{}) (*Stream, error) {
+	if stream, ok := value.(*Stream); ok {
+		return stream, nil
+	} else {
+		return nil, FmtError("Expected a stream, got:", value)
+	}
+}
+
+// ReadLine returns a line from the stream without the line ending, or
+// bufio.ErrFinalToken at the end of the file, like Readword.
+func (self *Stream) ReadLine() (string, error) {
+	return self.readLine(0)
+}
+
+// readLine is like ReadLine, but gives up on lines longer than limit
+// bytes, if positive, without reading the rest.
+func (self *Stream) readLine(limit int) (string, error) {
+	if self.in == nil {
+		return "", FmtError("Stream not open for reading:", self.Name)
+	}
+	line := make([]byte, 0)
+	for {
+		chunk, err := self.in.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			// Allow for a carriage return at the end.
+			if err := fitString(len(line) - 1, limit); err != nil {
+				return "", err
+			}
+			continue
+		} else if err == io.EOF && len(line) == 0 {
+			return "", bufio.ErrFinalToken
+		} else if err != nil && err != io.EOF {
+			return "", err
+		}
+		break
+	}
+	text := strings.TrimSuffix(string(line), "\n")
+	text = strings.TrimSuffix(text, "\r")
+	return text, fitString(len(text), limit)
+}
+
+// ReadChar returns the next character from the stream, or
+// bufio.ErrFinalToken at the end of the file.
+func (self *Stream) ReadChar() (string, error) {
+	if self.in == nil {
+		return "", FmtError("Stream not open for reading:", self.Name)
+	}
+	char, _, err := self.in.ReadRune()
+	if err == io.EOF {
+		return "", bufio.ErrFinalToken
+	} else if err != nil {
+		return "", err
+	}
+	return string(char), nil
+}
+
+// ReadAll returns whatever is left to read from the stream.
+func (self *Stream) ReadAll() (string, error) {
+	return self.readAll(0)
+}
+
+// readAll is like ReadAll, but gives up past limit bytes, if positive.
+func (self *Stream) readAll(limit int) (string, error) {
+	if self.in == nil {
+		return "", FmtError("Stream not open for reading:", self.Name)
+	}
+	return readUpTo(self.in, limit)
+}
+
+// readUpTo reads everything from in, but gives up past limit bytes, if
+// positive, without reading the rest.
+func readUpTo(in io.Reader, limit int) (string, error) {
+	if limit > 0 {
+		in = io.LimitReader(in, int64(limit) + 1)
+	}
+	text, err := io.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	return string(text), fitString(len(text), limit)
+}
+
+// readFile reads a whole file like readUpTo.
+func readFile(fn string, limit int) (string, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return readUpTo(file, limit)
+}
+
+// AtEOF tells if there's nothing left to read from the stream, waiting
+// for more input if need be.
+func (self *Stream) AtEOF() (bool, error) {
+	if self.in == nil {
+		return false, FmtError("Stream not open for reading:", self.Name)
+	}
+	_, err := self.in.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	} else {
+		return false, err
+	}
+}
+
+// ReadLines returns all the lines in a file, without line endings.
+func ReadLines(fn string) (List, error) {
+	return readLines(fn, 0)
+}
+
+// readLines is like ReadLines, but gives up on files longer than limit
+// bytes, if positive.
+func readLines(fn string, limit int) (List, error) {
+	text, err := readFile(fn, limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(text, "\n")
+	if lines[len(lines) - 1] == "" {
+		lines = lines[:len(lines) - 1]
+	}
+	for i, line := range(lines) {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return StringList(lines), nil
+}
+
+// WriteFile writes text to a file, replacing it or adding to the end.
+func WriteFile(fn, text string, appending bool) error {
+	mode := "w"
+	if appending {
+		mode = "a"
+	}
+	stream, err := Open(fn, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stream, text)
+	if err2 := stream.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// readAll reads the rest of a stream for a script, within its limits.
+func readAll(s *Scope, in *Stream) (interface{}, error) {
+	text, err := in.readAll(s.Interp.MaxString)
+	if err != nil {
+		return nil, err
+	}
+	return text, nil
+}
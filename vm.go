@@ -0,0 +1,417 @@
+package lunar
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// Code is compiled on first use into a flat list of instructions, so that
+// running it again needs neither type switches over the items nor scanning
+// of blocks. The instructions come in Polish order just like the source,
+// and are evaluated the same way; the compiled form is kept along with the
+// code, until the code is changed.
+
+type opcode uint8
+
+const (
+	opConst opcode = iota // push value
+	opVar // push the variable called name
+	opWord // call the function called name, or push value if none
+	opCall // call procs[arg]
+	opFail // report value, an error found while compiling
+)
+
+type instr struct {
+	op opcode
+	arg int32
+	at int32 // index of the item in the source, for positions
+	tail bool // whether the word comes right after return
+	own bool // whether the procedure is one of ours, see vars
+	name string
+	value interface{}
+}
+
+// program is code in compiled form. It doesn't keep the code itself, so
+// that the code can go away with the program still in codeTable; start and
+// size tell which part of the list it was compiled from.
+type program struct {
+	code []instr
+	procs []Builtin
+	pos []Pos
+	start int
+	size int
+	owner *Interpreter
+}
+
+// posAt returns the position of the item at index at in the source.
+func (self *program) posAt(at int32) Pos {
+	if int(at) < len(self.pos) {
+		return self.pos[at]
+	}
+	return Pos{}
+}
+
+// tailcall is a function call left for the caller to make.
+type tailcall struct {
+	closure Closure
+	args List
+	prog *program
+	pc int
+}
+
+// returnCode identifies the return procedure, whatever its name.
+var returnCode uintptr
+
+// ownCode identifies the procedures in Builtins, which are known to get
+// at the locals of function calls by way of Scope.vars; others may use
+// Names directly, so it has to be made for them.
+var ownCode = map[uintptr]bool{}
+
+func init() {
+	returnCode = reflect.ValueOf(Builtins["return"].Code).Pointer()
+}
+
+// isOwn tells if a procedure is one in Builtins.
+func isOwn(proc Builtin) bool {
+	return ownCode[reflect.ValueOf(proc.Code).Pointer()]
+}
+
+// parsing is a literal list as parsed for use as code, like while and
+// ifelse need it, by the interpreter that did it; start and size tell
+// which part of the list it was, like for programs.
+type parsing struct {
+	start int
+	size int
+	code List
+	owner *Interpreter
+}
+
+// compile turns code into instructions, scanning each block only once.
+// That means a block is the same list every time its code runs.
+func (self *Interpreter) compile(code List) *program {
+	prog := &program{
+		code: make([]instr, 0, len(code)), pos: positions(code),
+		size: len(code), owner: self}
+	quoted := literals(code)
+	tail := false
+	for i := 0; i < len(code); i++ {
+		ins := instr{op: opConst, at: int32(i), value: code[i]}
+		ins.tail, tail = tail, false
+		if quoted != nil && quoted[i] {
+			// String literals stand for themselves.
+			prog.code = append(prog.code, ins)
+			continue
+		}
+		switch value := code[i].(type) {
+		case Builtin:
+			ins.op = opCall
+			ins.arg = int32(len(prog.procs))
+			ins.own = isOwn(value)
+			prog.procs = append(prog.procs, value)
+			tail = reflect.ValueOf(value.Code).Pointer() == returnCode
+		case string:
+			if value == "" {
+				// Nothing to look up.
+			} else if value[0] == ':' {
+				// Expect name to be already lowercased.
+				ins.op = opVar
+				ins.name = value[1:]
+			} else if value == "do" {
+				block, csr, err := self.ScanBlock(code, i + 1)
+				if err != nil {
+					ins.op = opFail
+					ins.value = err
+					i = len(code)
+				} else {
+					ins.value = block
+					i = csr - 1
+				}
+			} else {
+				ins.op = opWord
+				ins.name = strings.ToLower(value)
+			}
+		}
+		prog.code = append(prog.code, ins)
+	}
+	return prog
+}
+
+// recent is a program the interpreter ran lately, saving a trip to the
+// codeTable when it runs it again. It keeps the code around, so that no
+// other code can turn up at the same address meanwhile.
+type recent struct {
+	first *interface{}
+	size int
+	info *codeInfo
+	prog *program
+}
+
+// program returns code in compiled form, reusing earlier work if possible.
+// Compiled code belongs to the interpreter that made it, which keeps notes
+// in there as it runs; any others compile their own.
+func (self *Interpreter) program(code List) *program {
+	if len(code) == 0 {
+		return &program{}
+	}
+	slot := &self.recent[uintptr(unsafe.Pointer(&code[0])) / 16 % 16]
+	if slot.first == &code[0] && slot.size == len(code) &&
+		slot.info.prog.Load() == slot.prog {
+		return slot.prog
+	}
+	info := infoOf(code)
+	if info == nil {
+		return self.compile(code)
+	}
+	start := info.offsetOf(code)
+	prog := info.prog.Load()
+	if prog == nil || prog.owner != self ||
+		prog.start != start || prog.size != len(code) {
+		old := prog
+		prog = self.compile(code)
+		prog.start = start
+		if old == nil || old.owner == self {
+			info.prog.CompareAndSwap(old, prog)
+		}
+	}
+	*slot = recent{&code[0], len(code), info, prog}
+	return prog
+}
+
+// parsed returns a literal list parsed as code, reusing earlier work if
+// possible, like program does.
+func (self *Interpreter) parsed(words List) (List, error) {
+	if len(words) == 0 {
+		return List{}, nil
+	}
+	info := infoOf(words)
+	var old *parsing
+	start := 0
+	if info != nil {
+		start = info.offsetOf(words)
+		old = info.parsed.Load()
+		if old != nil && old.owner == self &&
+			old.start == start && old.size == len(words) {
+			return old.code, nil
+		}
+	}
+	code, err := self.parseWords(words)
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && (old == nil || old.owner == self) {
+		info.parsed.CompareAndSwap(
+			old, &parsing{start, len(words), code, self})
+	}
+	return code, nil
+}
+
+// forget drops the compiled and parsed forms of a list whose item at
+// index is being replaced, along with those of any other list sharing
+// the same items; the new item is no string literal either.
+func forget(code List, index int) {
+	if info := infoOf(code); info != nil {
+		info.prog.Store(nil)
+		info.parsed.Store(nil)
+		if quoted := literals(code); quoted != nil {
+			quoted[index] = false
+		}
+	}
+}
+
+// exec runs compiled code. If collect is set, it gathers the value of each
+// statement, like Results; otherwise it expects none, like Run, and returns
+// the value passed to return, if any.
+func (self *Interpreter) exec(
+	prog *program, scope *Scope, collect bool,
+) (values List, value interface{}, err error) {
+	saved := self.mark()
+	at := int32(0)
+	defer func () {
+		if e := recover(); e != nil {
+			err = self.unwind(e, saved, prog, at)
+			values, value = nil, nil
+		}
+	}()
+
+	if collect {
+		values = make(List, 0, prog.size)
+	}
+	pc := 0
+	for pc < len(prog.code) {
+		stmt := prog.code[pc].at
+		value, pc, err = self.eval(prog, pc, scope, &at)
+		if err != nil {
+			return nil, nil, err
+		} else if collect {
+			if scope.returning {
+				return List{value}, nil, nil
+			} else if scope.breaking || scope.continuing {
+				return values, nil, nil
+			}
+			values = append(values, value)
+		} else if scope.continuing || scope.breaking {
+			return nil, nil, nil
+		} else if scope.returning {
+			return nil, value, nil
+		} else if value != nil {
+			err := FmtError("You don't say what to do with:", value)
+			err.Pos = prog.posAt(stmt)
+			return nil, value, err
+		}
+	}
+	return values, nil, nil
+}
+
+// eval evaluates the expression starting at pc, returning its value and
+// where the next one starts. It leaves the position of each call it makes
+// in at, in case the call panics.
+func (self *Interpreter) eval(
+	prog *program, pc int, scope *Scope, at *int32,
+) (interface{}, int, error) {
+	ins := &prog.code[pc]
+	if self.budget != nil {
+		if err := self.step(); err != nil {
+			return nil, pc, placed(err, prog.posAt(ins.at))
+		}
+	}
+	switch ins.op {
+	case opVar:
+		value, err := scope.Get(ins.name)
+		if err != nil {
+			return nil, pc, placed(err, prog.posAt(ins.at))
+		}
+		return value, pc + 1, nil
+	case opWord:
+		fn := scope.SafeGet(ins.name, nil)
+		if closure, ok := fn.(Closure); ok {
+			return self.apply(prog, pc, scope, at,
+				fn, len(closure.Arglist))
+		}
+		return ins.value, pc + 1, nil
+	case opCall:
+		proc := &prog.procs[ins.arg]
+		return self.apply(prog, pc, scope, at, nil, proc.Arity)
+	case opFail:
+		return nil, pc, ins.value.(error)
+	default:
+		return ins.value, pc + 1, nil
+	}
+}
+
+// apply evaluates the arguments of the call at pc, then makes the call.
+func (self *Interpreter) apply(prog *program, pc int, scope *Scope,
+	at *int32, fn interface{}, need int) (interface{}, int, error) {
+	ins := &prog.code[pc]
+	base := len(self.vals)
+	next := pc + 1
+	for i := 0; i < need; i++ {
+		if next >= len(prog.code) {
+			self.vals = self.vals[:base]
+			err := Error{
+				Data: "Not enough arguments.",
+				Pos: prog.posAt(ins.at)}
+			if fn != nil {
+				err.Data = "Not enough arguments to " + ins.name
+			}
+			return nil, next, err
+		}
+		value, csr, err := self.eval(prog, next, scope, at)
+		if err != nil {
+			self.vals = self.vals[:base]
+			return nil, csr, err
+		}
+		self.vals = append(self.vals, value)
+		next = csr
+	}
+	var value interface{}
+	var err error
+	args := self.vals[base:]
+	if fn != nil && ins.tail && scope.function {
+		value = self.postpone(prog, pc, fn, args, scope)
+	} else {
+		*at = ins.at
+		value, err = self.invoke(prog, pc, fn, args, scope)
+	}
+	self.vals = self.vals[:base]
+	return value, next, err
+}
+
+// mark is how far the interpreter's stacks went at some point.
+type mark struct {
+	stack int
+	vals int
+	depth int
+}
+
+func (self *Interpreter) mark() mark {
+	return mark{len(self.stack), len(self.vals), self.depth}
+}
+
+// unwind turns a panic in compiled code into an error, putting the
+// interpreter back the way it was at the given mark.
+func (self *Interpreter) unwind(
+	e interface{}, saved mark, prog *program, at int32) error {
+	var err error
+	if data, ok := e.(Error); ok {
+		err = data
+	} else {
+		err = Error{Data: fmt.Sprint(e)}
+	}
+	err = self.trace(placed(err, prog.posAt(at)))
+	self.stack = self.stack[:saved.stack]
+	self.vals = self.vals[:saved.vals]
+	self.depth = saved.depth
+	return err
+}
+
+// postpone leaves a call to a function for the one that's returning.
+func (self *Interpreter) postpone(prog *program, pc int, fn interface{},
+	args []interface{}, scope *Scope) interface{} {
+	scope.tail = &tailcall{
+		closure: fn.(Closure),
+		args: append(List(nil), args...),
+		prog: prog,
+		pc: pc}
+	return nil
+}
+
+// invoke calls the procedure or closure for the instruction at pc.
+func (self *Interpreter) invoke(prog *program, pc int, fn interface{},
+	args []interface{}, scope *Scope) (interface{}, error) {
+	ins := &prog.code[pc]
+	if fn != nil {
+		closure := fn.(Closure)
+		value, err := closure.call(prog, pc, args...)
+		return value, placed(err, prog.posAt(ins.at))
+	}
+	proc := prog.procs[ins.arg]
+	if self.MaxDepth > 0 && self.depth >= self.MaxDepth {
+		// Procedures like run can recurse just as well as functions,
+		// but it's more likely the function calling them does.
+		name := ""
+		for i := len(self.stack) - 1; i >= 0 && name == ""; i-- {
+			name = self.stack[i].name
+		}
+		if name == "" {
+			name = self.nameOf(proc)
+		}
+		err := Error{Data: "Stack depth exceeded in " + name}
+		return nil, placed(err, prog.posAt(ins.at))
+	}
+	if !ins.own {
+		// Others may keep their arguments, which are on the value stack.
+		scope.vars()
+		args = append(List(nil), args...)
+	}
+	self.depth++
+	self.stack = append(self.stack, frame{prog: prog, pc: int32(pc)})
+	value, err := proc.Code(scope, args...)
+	if err != nil {
+		err = self.trace(placed(err, prog.posAt(ins.at)))
+	}
+	self.stack = self.stack[:len(self.stack) - 1]
+	self.depth--
+	return value, err
+}
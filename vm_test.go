@@ -0,0 +1,50 @@
+package lunar
+
+import (
+	"runtime"
+	"testing"
+)
+
+// Procedures other than ours may hold on to their arguments, so they
+// can't be given a piece of the value stack.
+func TestHostProcedureArgs(t *testing.T) {
+	interp := NewInterpreter()
+	interp.Procedures["pair"] = Builtin{Arity: 2,
+		Code: func (s *Scope, a ...interface{}) (interface{}, error) {
+			return List(a), nil
+		}}
+	got := results(t, interp, `make p pair 1 2 make q pair 3 4 :p :q`)
+	if want := "[<nil> <nil> [1 2] [3 4]]"; ToString(got) != want {
+		t.Errorf("got %s, want %s", ToString(got), want)
+	}
+}
+
+// What the interpreter knows about code is kept apart from it, so that
+// hosts can append to it, and it goes away along with the code.
+func TestCodeInfo(t *testing.T) {
+	interp := NewInterpreter()
+	code := parseScript(t, interp, "make x 1 -- and then\nthrow \"oops\"")
+	if cap(code) == len(code) {
+		t.Fatal("no room to append to the code")
+	}
+	for _, i := range(code[len(code):cap(code)]) {
+		if i != nil {
+			t.Errorf("found %#v past the end of the code", i)
+		}
+	}
+	_ = append(code, "print")
+	_, err := Run(code, interp.Toplevel)
+	if pos := err.(Error).Pos; pos.Line != 2 {
+		t.Errorf("error at %v, want line 2", pos)
+	}
+	for i := 0; i < 10000; i++ {
+		parseScript(t, interp, "make x [1 2 3] do print :x end")
+	}
+	runtime.GC()
+	codeTable.Lock()
+	defer codeTable.Unlock()
+	sweepCode()
+	if n := len(codeTable.infos); n > 1000 {
+		t.Errorf("%d lists of code are still known", n)
+	}
+}